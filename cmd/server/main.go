@@ -1,32 +1,53 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
+	"os"
+	"video_conferencing_server/internal/auth"
+	"video_conferencing_server/internal/config"
 	"video_conferencing_server/internal/handlers"
 	"video_conferencing_server/internal/logger"
 	"video_conferencing_server/internal/room"
-
-	"github.com/pion/webrtc/v4"
 )
 
 func main() {
 	// Application entry point
-	rtcConfig := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	cfg, err := config.Parse(os.Args[0], os.Args[1:])
+	if err != nil {
+		logger.LogError("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	verifier, err := auth.NewVerifier(cfg.Auth.JWT)
+	if err != nil {
+		logger.LogError("Invalid join token configuration", "error", err)
+		os.Exit(1)
+	}
+	if cfg.Server.DevMode {
+		logger.Logger.Warn("Development mode: WebSocket connections are accepted from any origin")
 	}
-	roomManager := room.NewManager()
-	wsHandler := handlers.NewWebSocketHandler(roomManager, rtcConfig)
+	roomManager := room.NewManager(cfg)
+	wsHandler := handlers.NewWebSocketHandler(roomManager, cfg, verifier)
 
-	http.HandleFunc("/ws", wsHandler.Handle)
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
+	// Not http.DefaultServeMux, expvar puts the metrics there
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", wsHandler.Handle)
+	fs := http.FileServer(http.Dir(cfg.Server.StaticDir))
+	mux.Handle("/", fs)
+
+	if cfg.Server.MetricsAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			logger.LogInfo("Metrics served on " + cfg.Server.MetricsAddr)
+			if err := http.ListenAndServe(cfg.Server.MetricsAddr, admin); err != nil {
+				logger.LogError("Error starting metrics server", "error", err)
+			}
+		}()
+	}
 
-	logger.LogInfo("WebSocket server started on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	logger.LogInfo("WebSocket server started on " + cfg.Server.ListenAddr)
+	if err := http.ListenAndServe(cfg.Server.ListenAddr, mux); err != nil {
 		logger.LogError("Error starting server", "error", err)
 	}
 }
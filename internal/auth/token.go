@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"video_conferencing_server/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTokenRequired  = errors.New("an access token is required")
+	ErrInvalidToken   = errors.New("invalid access token")
+	ErrRoomNotAllowed = errors.New("the access token does not grant access to this room")
+)
+
+// Claims is what our backend puts in the join tokens it issues
+type Claims struct {
+	Name  string   `json:"name"`
+	Rooms []string `json:"rooms"` // Room IDs the holder may join, empty means any room
+	Role  string   `json:"role"`  // "owner", "admin" or empty for a regular participant
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user the token was issued to (the "sub" claim)
+func (c *Claims) UserID() (uuid.UUID, error) {
+	return uuid.Parse(c.Subject)
+}
+
+// AllowsRoom reports whether the token may be used to join the room
+func (c *Claims) AllowsRoom(roomID string) bool {
+	return len(c.Rooms) == 0 || slices.Contains(c.Rooms, roomID)
+}
+
+// Verifier checks join tokens signed with the locally configured HMAC secret or Ed25519 key
+type Verifier struct {
+	required bool
+	key      interface{}
+	parser   *jwt.Parser
+}
+
+// NewVerifier builds a verifier from the configuration, it returns nil when no key is configured
+func NewVerifier(cfg config.JWTConfig) (*Verifier, error) {
+	v := &Verifier{required: cfg.Required}
+	var methods []string
+	switch {
+	case cfg.HMACSecret != "":
+		v.key = []byte(cfg.HMACSecret)
+		methods = []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodHS384.Alg(), jwt.SigningMethodHS512.Alg()}
+	case cfg.Ed25519PublicKeyFile != "":
+		raw, err := os.ReadFile(cfg.Ed25519PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Ed25519 public key: %w", err)
+		}
+		key, err := jwt.ParseEdPublicKeyFromPEM(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Ed25519 public key: %w", err)
+		}
+		if _, ok := key.(ed25519.PublicKey); !ok {
+			return nil, errors.New("public key is not an Ed25519 key")
+		}
+		v.key = key
+		methods = []string{jwt.SigningMethodEdDSA.Alg()}
+	default:
+		return nil, nil
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(options...)
+	return v, nil
+}
+
+// Required reports whether every join has to carry a token
+func (v *Verifier) Required() bool {
+	return v != nil && v.required
+}
+
+// Verify checks the signature and validity of a token and returns its claims.
+// Without a token it returns nil claims, or ErrTokenRequired when tokens are mandatory.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	if token == "" {
+		if v.Required() {
+			return nil, ErrTokenRequired
+		}
+		return nil, nil
+	}
+	if v == nil {
+		return nil, nil // Authentication is disabled, tokens are ignored
+	}
+
+	claims := &Claims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, fmt.Errorf("%w: subject is not a user id", ErrInvalidToken)
+	}
+	return claims, nil
+}
@@ -0,0 +1,464 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to every environment variable the config reads
+const EnvPrefix = "VCS_"
+
+type Config struct {
+	Server ServerConfig `yaml:"server" json:"server"`
+	WebRTC WebRTCConfig `yaml:"webrtc" json:"webrtc"`
+	Rooms  RoomsConfig  `yaml:"rooms" json:"rooms"`
+	Auth   AuthConfig   `yaml:"auth" json:"auth"`
+}
+
+type ServerConfig struct {
+	ListenAddr     string   `yaml:"listenAddr" json:"listenAddr"`
+	StaticDir      string   `yaml:"staticDir" json:"staticDir"`
+	AllowedOrigins []string `yaml:"allowedOrigins" json:"allowedOrigins"` // Origins allowed to open /ws, empty means same-origin only
+	DevMode        bool     `yaml:"devMode" json:"devMode"`               // Accepts every origin, never use in production
+	MetricsAddr    string   `yaml:"metricsAddr" json:"metricsAddr"`       // Admin listener serving /debug/vars, empty disables it
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls" json:"urls"`
+	Username   string   `yaml:"username" json:"username"`
+	Credential string   `yaml:"credential" json:"credential"`
+}
+
+type WebRTCConfig struct {
+	ICEServers []ICEServer `yaml:"iceServers" json:"iceServers"`
+	RTPTapAddr string      `yaml:"rtpTapAddr" json:"rtpTapAddr"` // Debugging UDP address every forwarded RTP packet is copied to (empty disables)
+	// Stop forwarding audio/video of peers that report it muted (media-state) to save bandwidth
+	DropMutedMedia bool              `yaml:"dropMutedMedia" json:"dropMutedMedia"`
+	DataChannels   DataChannelConfig `yaml:"dataChannels" json:"dataChannels"`
+	Bandwidth      BandwidthConfig   `yaml:"bandwidth" json:"bandwidth"`
+	Keyframes      KeyframeConfig    `yaml:"keyframes" json:"keyframes"`
+	Codecs         CodecConfig       `yaml:"codecs" json:"codecs"`
+}
+
+// CodecConfig lists the codecs peers may negotiate as MIME types, most preferred first. Rooms may
+// narrow the video list down, see VideoCodecs.
+type CodecConfig struct {
+	Video []string `yaml:"video" json:"video"`
+	Audio []string `yaml:"audio" json:"audio"`
+}
+
+// VideoCodecs and AudioCodecs are the codecs the server knows how to forward
+var (
+	VideoCodecs = []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeAV1}
+	AudioCodecs = []string{webrtc.MimeTypeOpus, webrtc.MimeTypeG722, webrtc.MimeTypePCMU, webrtc.MimeTypePCMA}
+)
+
+// KeyframeConfig tunes the keyframe requests (PLI) sent to publishers. They are sent when a
+// subscriber needs one: it joined, switched layers or reported a loss.
+type KeyframeConfig struct {
+	MinIntervalMillis int `yaml:"minIntervalMillis" json:"minIntervalMillis"` // Per publisher layer, requests in between are merged
+	FallbackSeconds   int `yaml:"fallbackSeconds" json:"fallbackSeconds"`     // Periodic request for clients that ignore the others, 0 disables it
+}
+
+// BandwidthConfig tunes the bandwidth estimation run for every subscriber, the estimate decides which
+// simulcast layers each one receives. Bitrates are in bits per second.
+type BandwidthConfig struct {
+	CongestionControl bool `yaml:"congestionControl" json:"congestionControl"` // TWCC based, without it only REMB from the browser is used
+	InitialBitrate    int  `yaml:"initialBitrate" json:"initialBitrate"`
+	MinBitrate        int  `yaml:"minBitrate" json:"minBitrate"`
+	MaxBitrate        int  `yaml:"maxBitrate" json:"maxBitrate"`
+}
+
+// DataChannelConfig limits what a single peer may push through the data channel relay,
+// messages over either budget are dropped rather than queued
+type DataChannelConfig struct {
+	MaxMessagesPerSecond int `yaml:"maxMessagesPerSecond" json:"maxMessagesPerSecond"`
+	MaxBytesPerSecond    int `yaml:"maxBytesPerSecond" json:"maxBytesPerSecond"` // Also the largest message relayed
+}
+
+type RoomsConfig struct {
+	DefaultCapacity  int                    `yaml:"defaultCapacity" json:"defaultCapacity"`
+	MaxCapacity      int                    `yaml:"maxCapacity" json:"maxCapacity"` // Upper bound for capacities requested by room creators
+	PasswordAttempts PasswordAttemptsConfig `yaml:"passwordAttempts" json:"passwordAttempts"`
+	ChatHistorySize  int                    `yaml:"chatHistorySize" json:"chatHistorySize"` // Messages replayed to late joiners, 0 disables the history
+	ChatMaxLength    int                    `yaml:"chatMaxLength" json:"chatMaxLength"`     // In characters
+	SinglePresenter  bool                   `yaml:"singlePresenter" json:"singlePresenter"` // Default policy, room creators may override it
+}
+
+// PasswordAttemptsConfig limits wrong room passwords, once a limit is hit further attempts
+// are refused until the window that started with the first failure is over
+type PasswordAttemptsConfig struct {
+	MaxPerIP      int `yaml:"maxPerIP" json:"maxPerIP"`
+	MaxPerRoom    int `yaml:"maxPerRoom" json:"maxPerRoom"`
+	WindowSeconds int `yaml:"windowSeconds" json:"windowSeconds"`
+}
+
+type AuthConfig struct {
+	// Header carrying the authenticated user id (a UUID) set by a trusted reverse proxy.
+	// Empty disables it, never enable it when clients can reach the server directly.
+	UserIDHeader string    `yaml:"userIdHeader" json:"userIdHeader"`
+	JWT          JWTConfig `yaml:"jwt" json:"jwt"`
+}
+
+// JWTConfig describes the join tokens issued by our backend, signed either with
+// an HMAC secret (HS256/384/512) or an Ed25519 key (EdDSA)
+type JWTConfig struct {
+	Required             bool   `yaml:"required" json:"required"` // Refuse joins without a valid token
+	HMACSecret           string `yaml:"hmacSecret" json:"hmacSecret"`
+	Ed25519PublicKeyFile string `yaml:"ed25519PublicKeyFile" json:"ed25519PublicKeyFile"` // PEM encoded
+	Issuer               string `yaml:"issuer" json:"issuer"`
+	Audience             string `yaml:"audience" json:"audience"`
+}
+
+// Default returns the configuration used when nothing overrides it
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ListenAddr: ":8080",
+			StaticDir:  "./static",
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: []ICEServer{
+				{URLs: []string{"stun:stun.l.google.com:19302"}},
+			},
+			DataChannels: DataChannelConfig{
+				MaxMessagesPerSecond: 100,
+				MaxBytesPerSecond:    256 * 1024,
+			},
+			Bandwidth: BandwidthConfig{
+				CongestionControl: true,
+				InitialBitrate:    1_000_000,
+				MinBitrate:        100_000,
+				MaxBitrate:        20_000_000,
+			},
+			Keyframes: KeyframeConfig{
+				MinIntervalMillis: 500,
+			},
+			Codecs: CodecConfig{
+				Video: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeAV1},
+				Audio: []string{webrtc.MimeTypeOpus},
+			},
+		},
+		Rooms: RoomsConfig{
+			DefaultCapacity: 50,
+			MaxCapacity:     100,
+			PasswordAttempts: PasswordAttemptsConfig{
+				MaxPerIP:      5,
+				MaxPerRoom:    20,
+				WindowSeconds: 300,
+			},
+			ChatHistorySize: 100,
+			ChatMaxLength:   2000,
+		},
+	}
+}
+
+// Load builds a configuration from the defaults, the given file (if any) and the environment
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parse loads the configuration for the command line arguments.
+// Precedence (lowest to highest): defaults, config file, environment, flags.
+func Parse(name string, args []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path to a YAML or JSON config file")
+	listenAddr := fs.String("listen", "", "address the HTTP server listens on")
+	staticDir := fs.String("static", "", "directory served at /")
+	iceServers := fs.String("ice-servers", "", "comma separated list of ICE server URLs")
+	allowedOrigins := fs.String("allowed-origins", "", "comma separated list of origins allowed to open /ws")
+	devMode := fs.Bool("dev", false, "development mode, accepts WebSocket connections from any origin")
+	roomCapacity := fs.Int("room-capacity", 0, "default number of peers allowed in a room")
+	maxRoomCapacity := fs.Int("max-room-capacity", 0, "largest capacity a room creator may request")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := Load(*path)
+	if err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Server.ListenAddr = *listenAddr
+		case "static":
+			cfg.Server.StaticDir = *staticDir
+		case "allowed-origins":
+			cfg.Server.AllowedOrigins = splitList(*allowedOrigins)
+		case "dev":
+			cfg.Server.DevMode = *devMode
+		case "ice-servers":
+			cfg.WebRTC.ICEServers = parseICEServers(*iceServers)
+		case "room-capacity":
+			cfg.Rooms.DefaultCapacity = *roomCapacity
+		case "max-room-capacity":
+			cfg.Rooms.MaxCapacity = *maxRoomCapacity
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, c)
+	case ".json":
+		err = json.Unmarshal(raw, c)
+	default:
+		return fmt.Errorf("unsupported config file extension %q (want .yaml, .yml or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if v, ok := lookup(EnvPrefix + "LISTEN_ADDR"); ok {
+		c.Server.ListenAddr = v
+	}
+	if v, ok := lookup(EnvPrefix + "STATIC_DIR"); ok {
+		c.Server.StaticDir = v
+	}
+	if v, ok := lookup(EnvPrefix + "METRICS_ADDR"); ok {
+		c.Server.MetricsAddr = v
+	}
+	if v, ok := lookup(EnvPrefix + "ALLOWED_ORIGINS"); ok {
+		c.Server.AllowedOrigins = splitList(v)
+	}
+	if v, ok := lookup(EnvPrefix + "DEV_MODE"); ok {
+		devMode, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sDEV_MODE: %w", EnvPrefix, err)
+		}
+		c.Server.DevMode = devMode
+	}
+	if v, ok := lookup(EnvPrefix + "ICE_SERVERS"); ok {
+		c.WebRTC.ICEServers = parseICEServers(v)
+	}
+	if v, ok := lookup(EnvPrefix + "RTP_TAP_ADDR"); ok {
+		c.WebRTC.RTPTapAddr = v
+	}
+	if v, ok := lookup(EnvPrefix + "DROP_MUTED_MEDIA"); ok {
+		drop, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sDROP_MUTED_MEDIA: %w", EnvPrefix, err)
+		}
+		c.WebRTC.DropMutedMedia = drop
+	}
+	if v, ok := lookup(EnvPrefix + "DATA_CHANNEL_MAX_MESSAGES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sDATA_CHANNEL_MAX_MESSAGES: %w", EnvPrefix, err)
+		}
+		c.WebRTC.DataChannels.MaxMessagesPerSecond = n
+	}
+	if v, ok := lookup(EnvPrefix + "DATA_CHANNEL_MAX_BYTES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sDATA_CHANNEL_MAX_BYTES: %w", EnvPrefix, err)
+		}
+		c.WebRTC.DataChannels.MaxBytesPerSecond = n
+	}
+	if v, ok := lookup(EnvPrefix + "CONGESTION_CONTROL"); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sCONGESTION_CONTROL: %w", EnvPrefix, err)
+		}
+		c.WebRTC.Bandwidth.CongestionControl = enabled
+	}
+	if v, ok := lookup(EnvPrefix + "KEYFRAME_FALLBACK_SECONDS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sKEYFRAME_FALLBACK_SECONDS: %w", EnvPrefix, err)
+		}
+		c.WebRTC.Keyframes.FallbackSeconds = n
+	}
+	if v, ok := lookup(EnvPrefix + "VIDEO_CODECS"); ok {
+		c.WebRTC.Codecs.Video = splitList(v)
+	}
+	if v, ok := lookup(EnvPrefix + "AUDIO_CODECS"); ok {
+		c.WebRTC.Codecs.Audio = splitList(v)
+	}
+	if v, ok := lookup(EnvPrefix + "AUTH_USER_ID_HEADER"); ok {
+		c.Auth.UserIDHeader = v
+	}
+	if v, ok := lookup(EnvPrefix + "AUTH_JWT_REQUIRED"); ok {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sAUTH_JWT_REQUIRED: %w", EnvPrefix, err)
+		}
+		c.Auth.JWT.Required = required
+	}
+	if v, ok := lookup(EnvPrefix + "AUTH_JWT_HMAC_SECRET"); ok {
+		c.Auth.JWT.HMACSecret = v
+	}
+	if v, ok := lookup(EnvPrefix + "AUTH_JWT_ED25519_PUBLIC_KEY_FILE"); ok {
+		c.Auth.JWT.Ed25519PublicKeyFile = v
+	}
+	if v, ok := lookup(EnvPrefix + "ROOM_CAPACITY"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sROOM_CAPACITY: %w", EnvPrefix, err)
+		}
+		c.Rooms.DefaultCapacity = n
+	}
+	if v, ok := lookup(EnvPrefix + "MAX_ROOM_CAPACITY"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sMAX_ROOM_CAPACITY: %w", EnvPrefix, err)
+		}
+		c.Rooms.MaxCapacity = n
+	}
+	if v, ok := lookup(EnvPrefix + "SINGLE_PRESENTER"); ok {
+		single, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sSINGLE_PRESENTER: %w", EnvPrefix, err)
+		}
+		c.Rooms.SinglePresenter = single
+	}
+	return nil
+}
+
+func parseICEServers(list string) []ICEServer {
+	var servers []ICEServer
+	for _, url := range splitList(list) {
+		servers = append(servers, ICEServer{URLs: []string{url}})
+	}
+	return servers
+}
+
+// splitList splits a comma separated value, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate reports every problem found in the configuration at once
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.ListenAddr == "" {
+		errs = append(errs, errors.New("server.listenAddr must not be empty"))
+	}
+	if c.Server.StaticDir == "" {
+		errs = append(errs, errors.New("server.staticDir must not be empty"))
+	}
+	if c.Server.MetricsAddr != "" && c.Server.MetricsAddr == c.Server.ListenAddr {
+		errs = append(errs, errors.New("server.metricsAddr must differ from server.listenAddr, the metrics are not public"))
+	}
+	for i, origin := range c.Server.AllowedOrigins {
+		if origin == "*" || (strings.Contains(origin, "/") && !strings.Contains(origin, "://")) {
+			errs = append(errs, fmt.Errorf("server.allowedOrigins[%d]: invalid origin %q (use devMode to allow everything)", i, origin))
+		}
+	}
+	for i, server := range c.WebRTC.ICEServers {
+		if len(server.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("webrtc.iceServers[%d] has no urls", i))
+		}
+		for _, url := range server.URLs {
+			if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") &&
+				!strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+				errs = append(errs, fmt.Errorf("webrtc.iceServers[%d]: invalid url %q", i, url))
+			}
+		}
+	}
+	if c.WebRTC.DataChannels.MaxMessagesPerSecond < 1 || c.WebRTC.DataChannels.MaxBytesPerSecond < 1 {
+		errs = append(errs, errors.New("webrtc.dataChannels limits must be at least 1"))
+	}
+	if bw := c.WebRTC.Bandwidth; bw.MinBitrate < 1 || bw.InitialBitrate < bw.MinBitrate || bw.MaxBitrate < bw.InitialBitrate {
+		errs = append(errs, errors.New("webrtc.bandwidth: need 0 < minBitrate <= initialBitrate <= maxBitrate"))
+	}
+	if c.WebRTC.Keyframes.MinIntervalMillis < 0 || c.WebRTC.Keyframes.FallbackSeconds < 0 {
+		errs = append(errs, errors.New("webrtc.keyframes intervals must not be negative"))
+	}
+	errs = append(errs, validateCodecs("webrtc.codecs.video", c.WebRTC.Codecs.Video, VideoCodecs)...)
+	errs = append(errs, validateCodecs("webrtc.codecs.audio", c.WebRTC.Codecs.Audio, AudioCodecs)...)
+	if c.Rooms.DefaultCapacity < 1 {
+		errs = append(errs, errors.New("rooms.defaultCapacity must be at least 1"))
+	}
+	if c.Rooms.MaxCapacity < c.Rooms.DefaultCapacity {
+		errs = append(errs, errors.New("rooms.maxCapacity must not be lower than rooms.defaultCapacity"))
+	}
+	if c.Rooms.PasswordAttempts.MaxPerIP < 1 || c.Rooms.PasswordAttempts.MaxPerRoom < 1 {
+		errs = append(errs, errors.New("rooms.passwordAttempts limits must be at least 1"))
+	}
+	if c.Rooms.PasswordAttempts.WindowSeconds < 1 {
+		errs = append(errs, errors.New("rooms.passwordAttempts.windowSeconds must be at least 1"))
+	}
+	if c.Rooms.ChatHistorySize < 0 {
+		errs = append(errs, errors.New("rooms.chatHistorySize must not be negative"))
+	}
+	if c.Rooms.ChatMaxLength < 1 {
+		errs = append(errs, errors.New("rooms.chatMaxLength must be at least 1"))
+	}
+	jwt := c.Auth.JWT
+	if jwt.HMACSecret != "" && jwt.Ed25519PublicKeyFile != "" {
+		errs = append(errs, errors.New("auth.jwt: set either hmacSecret or ed25519PublicKeyFile, not both"))
+	}
+	if jwt.Required && jwt.HMACSecret == "" && jwt.Ed25519PublicKeyFile == "" {
+		errs = append(errs, errors.New("auth.jwt.required needs hmacSecret or ed25519PublicKeyFile"))
+	}
+	if jwt.HMACSecret != "" && len(jwt.HMACSecret) < 32 {
+		errs = append(errs, errors.New("auth.jwt.hmacSecret must be at least 32 bytes"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateCodecs checks a codec preference list against the codecs the server knows
+func validateCodecs(key string, codecs, known []string) []error {
+	if len(codecs) == 0 {
+		return []error{fmt.Errorf("%s must list at least one codec", key)}
+	}
+	var errs []error
+	for i, codec := range codecs {
+		if !slices.ContainsFunc(known, func(k string) bool { return strings.EqualFold(k, codec) }) {
+			errs = append(errs, fmt.Errorf("%s[%d]: unsupported codec %q (one of %s)", key, i, codec, strings.Join(known, ", ")))
+		}
+	}
+	return errs
+}
+
+// RTCConfiguration converts the WebRTC section into the pion configuration used for every PeerConnection
+func (c WebRTCConfig) RTCConfiguration() webrtc.Configuration {
+	servers := make([]webrtc.ICEServer, 0, len(c.ICEServers))
+	for _, s := range c.ICEServers {
+		server := webrtc.ICEServer{URLs: s.URLs, Username: s.Username}
+		if s.Credential != "" {
+			server.Credential = s.Credential
+		}
+		servers = append(servers, server)
+	}
+	return webrtc.Configuration{ICEServers: servers}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/metrics"
+)
+
+// newOriginChecker builds the upgrader's CheckOrigin. Patterns are either full origins
+// ("https://meet.example.com"), hosts ("meet.example.com", "localhost:8080") or wildcard
+// subdomains ("*.example.com"). Without patterns only same-origin requests are accepted,
+// in dev mode everything is.
+func newOriginChecker(allowed []string, devMode bool) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || devMode {
+			return true // Non-browser clients don't send an Origin
+		}
+		u, err := url.Parse(origin)
+		if err == nil && originAllowed(u, r.Host, allowed) {
+			return true
+		}
+		logger.LogError("WebSocket upgrade rejected for origin", "origin", origin, "host", r.Host, "remoteAddr", r.RemoteAddr)
+		metrics.RejectedOrigins.Add(1)
+		return false
+	}
+}
+
+func originAllowed(origin *url.URL, requestHost string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return strings.EqualFold(origin.Host, requestHost)
+	}
+	for _, pattern := range allowed {
+		if matchOrigin(origin, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(origin *url.URL, pattern string) bool {
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(scheme, origin.Scheme) {
+			return false
+		}
+		pattern = rest
+	}
+	host := origin.Hostname()
+	if strings.Contains(pattern, ":") {
+		host = origin.Host // The pattern pins a port
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return len(host) > len(suffix)+1 && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix))
+	}
+	return strings.EqualFold(host, pattern)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// failureLimiter counts failures per key in fixed windows and blocks a key once it reaches the limit.
+// Attempts are counted before they are checked (Reserve) and handed back when they turn out fine
+// (Release, Reset), so parallel attempts can't all slip past the limit before the first one fails.
+type failureLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	failures map[string]*failureWindow
+}
+
+type failureWindow struct {
+	count int
+	start time.Time
+}
+
+func newFailureLimiter(limit int, window time.Duration) *failureLimiter {
+	return &failureLimiter{
+		limit:    limit,
+		window:   window,
+		failures: make(map[string]*failureWindow),
+	}
+}
+
+// Reserve counts an attempt for the key as failed until told otherwise. It returns how long the key
+// stays blocked instead, without counting anything, when the limit is already reached.
+func (l *failureLimiter) Reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, ok := l.failures[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.prune(now)
+		w = &failureWindow{start: now}
+		l.failures[key] = w
+	}
+	if w.count >= l.limit {
+		return w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	return 0
+}
+
+// Release hands back a reserved attempt that didn't fail
+func (l *failureLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, ok := l.failures[key]; ok && w.count > 0 {
+		w.count--
+	}
+}
+
+// Reset forgets the failures of a key, e.g. after a successful attempt
+func (l *failureLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// prune drops expired windows so the map doesn't grow forever, the caller holds mu
+func (l *failureLimiter) prune(now time.Time) {
+	for key, w := range l.failures {
+		if now.Sub(w.start) >= l.window {
+			delete(l.failures, key)
+		}
+	}
+}
@@ -3,31 +3,46 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"net"
 	"net/http"
+	"time"
+	"video_conferencing_server/internal/auth"
+	"video_conferencing_server/internal/config"
 	"video_conferencing_server/internal/logger"
 	"video_conferencing_server/internal/models"
 	"video_conferencing_server/internal/room"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/pion/webrtc/v4"
 )
 
 type WebSocketHandler struct {
-	Manager   *room.Manager
-	Upgrader  websocket.Upgrader
-	RTCConfig webrtc.Configuration
+	Manager  *room.Manager
+	Upgrader websocket.Upgrader
+	Config   *config.Config
+	Verifier *auth.Verifier // nil when join tokens are disabled
+
+	ipPasswordFailures   *failureLimiter
+	roomPasswordFailures *failureLimiter
 }
 
+var (
+	errTooManyAttempts = errors.New("too many failed password attempts, try again later")
+	errAlreadyJoined   = errors.New("this connection already joined or is waiting to join a room")
+)
+
 // NewWebSocketHandler creates a new WebSocket handler for managing peer connections
-func NewWebSocketHandler(m *room.Manager, config webrtc.Configuration) *WebSocketHandler {
+func NewWebSocketHandler(m *room.Manager, cfg *config.Config, verifier *auth.Verifier) *WebSocketHandler {
+	attempts := cfg.Rooms.PasswordAttempts
+	window := time.Duration(attempts.WindowSeconds) * time.Second
 	return &WebSocketHandler{
-		Manager:   m,
-		RTCConfig: config,
+		Manager:              m,
+		Config:               cfg,
+		Verifier:             verifier,
+		ipPasswordFailures:   newFailureLimiter(attempts.MaxPerIP, window),
+		roomPasswordFailures: newFailureLimiter(attempts.MaxPerRoom, window),
 		Upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin: newOriginChecker(cfg.Server.AllowedOrigins, cfg.Server.DevMode),
 		},
 	}
 }
@@ -50,6 +65,10 @@ func (h *WebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		if required, restricted := commandRoles[message.Event]; restricted && !h.authorize(currentRoom, &currentPeer, message.Event, required) {
+			continue
+		}
+
 		switch message.Event {
 		case models.MessageTypeOffer:
 			err := currentRoom.HandleOffer(&currentPeer, message.Data)
@@ -75,12 +94,163 @@ func (h *WebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
 				logger.LogError("ICE candidate handling error", "error", err)
 			}
 		case models.MessageTypeJoin:
-			currentRoom, err = h.handleJoin(conn, message.Data, &currentPeer, currentRoom) // Updates currentRoom and currentPeer
+			currentRoom, err = h.handleJoin(conn, r, message.Data, &currentPeer, currentRoom) // Updates currentRoom and currentPeer
 			if err != nil {
 				logger.LogError("Join handling error", "error", err)
+				if isAuthError(err) {
+					continue // The client may retry with the right password
+				}
+				if errors.Is(err, errAlreadyJoined) {
+					continue // Still in the room it joined first
+				}
 				return
 			}
 			// currentPeer = peer
+		case models.MessageTypeLockRoom, models.MessageTypeUnlockRoom:
+			currentRoom.SetLocked(message.Event == models.MessageTypeLockRoom)
+		case models.MessageTypeAdmit:
+			target, err := parseTarget(message.Data)
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			admitted, err := currentRoom.AdmitPeer(target)
+			if err != nil {
+				logger.LogError("Admit handling error", "error", err, "peerId", target.String())
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			h.completeJoin(currentRoom, admitted)
+		case models.MessageTypeDeny:
+			target, err := parseTarget(message.Data)
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if err := currentRoom.DenyPeer(target); err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeWhitelistAdd, models.MessageTypeWhitelistRemove:
+			var payload models.UserTargetPayload
+			if err := json.Unmarshal(message.Data, &payload); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			target, err := uuid.Parse(payload.UserID)
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if message.Event == models.MessageTypeWhitelistAdd {
+				currentRoom.AddToWhitelist(target)
+			} else if err := currentRoom.RemoveFromWhitelist(currentPeer.ID, target); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			whitelist := models.WhitelistPayload{UserIDs: []string{}}
+			for _, id := range currentRoom.Whitelist() {
+				whitelist.UserIDs = append(whitelist.UserIDs, id.String())
+			}
+			currentRoom.SignalPeer(&currentPeer, models.MessageTypeWhitelist, whitelist, true)
+		case models.MessageTypePromoteAdmin, models.MessageTypeDemoteAdmin, models.MessageTypeTransferOwnership:
+			target, err := parseTarget(message.Data)
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if message.Event == models.MessageTypeTransferOwnership {
+				err = currentRoom.TransferOwnership(target)
+			} else {
+				err = currentRoom.SetAdmin(target, message.Event == models.MessageTypePromoteAdmin)
+			}
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeKick, models.MessageTypeMutePeer, models.MessageTypeDisableVideo:
+			var payload models.ModerationPayload
+			if err := json.Unmarshal(message.Data, &payload); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			target, err := uuid.Parse(payload.PeerID)
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			switch message.Event {
+			case models.MessageTypeKick:
+				err = currentRoom.Kick(currentPeer.ID, target, payload.Reason)
+			case models.MessageTypeMutePeer:
+				err = currentRoom.ForceMute(currentPeer.ID, target, !payload.Revert, payload.Reason)
+			case models.MessageTypeDisableVideo:
+				err = currentRoom.DisableVideo(currentPeer.ID, target, !payload.Revert, payload.Reason)
+			}
+			if err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeGetRoster:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			currentRoom.SignalPeer(&currentPeer, models.MessageTypeRoster, currentRoom.Roster(), true)
+		case models.MessageTypeMediaState:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			var state models.MediaStatePayload
+			if err := json.Unmarshal(message.Data, &state); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			currentRoom.SetMediaState(&currentPeer, state)
+		case models.MessageTypeChat:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			var request models.ChatRequest
+			if err := json.Unmarshal(message.Data, &request); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if err := currentRoom.SendChat(&currentPeer, request); err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeSetLayer:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			var request models.LayerRequestPayload
+			if err := json.Unmarshal(message.Data, &request); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if err := currentRoom.SetPreferredLayer(&currentPeer, request); err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeGetStats:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			currentRoom.SignalPeer(&currentPeer, models.MessageTypeStats, currentRoom.ReceiveStats(&currentPeer), true)
+		case models.MessageTypeShareStart:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			var share models.ShareStartPayload
+			if err := json.Unmarshal(message.Data, &share); err != nil {
+				signalError(&currentPeer, message.Event, err)
+				continue
+			}
+			if err := currentRoom.StartShare(&currentPeer, share.TrackIDs); err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
+		case models.MessageTypeShareStop:
+			if !currentRoom.IsCreated() || !currentRoom.HasPeer(&currentPeer) {
+				continue
+			}
+			if err := currentRoom.StopShare(&currentPeer); err != nil {
+				signalError(&currentPeer, message.Event, err)
+			}
 		case models.MessageTypeLeave:
 			if currentPeer.IsCreated() && currentRoom.IsCreated() {
 				currentRoom.RemovePeer(&currentPeer)
@@ -101,27 +271,95 @@ func (h *WebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *WebSocketHandler) handleJoin(conn *websocket.Conn, data json.RawMessage, currentPeer *models.Peer, currentRoom *room.Room) (*room.Room, error) {
+func (h *WebSocketHandler) handleJoin(conn *websocket.Conn, req *http.Request, data json.RawMessage, currentPeer *models.Peer, currentRoom *room.Room) (*room.Room, error) {
 	var payload struct {
-		RoomID string `json:"roomId"`
-		PeerID string `json:"peerId"`
+		RoomID   string `json:"roomId"`
+		PeerID   string `json:"peerId"`
+		Token    string `json:"token"`    // Join token issued by our backend, see auth.Claims
+		Capacity int    `json:"capacity"` // Only used when the join creates the room
+		Password string `json:"password"` // Sets the password when the join creates the room, checked otherwise
+		Private  bool   `json:"private"`  // Only used when the join creates the room
+
+		SinglePresenter *bool    `json:"singlePresenter"` // Only used when the join creates the room, the server default otherwise
+		VideoCodecs     []string `json:"videoCodecs"`     // Only used when the join creates the room, MIME types most preferred first
+
+		DisplayName string            `json:"displayName"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if currentPeer.IsCreated() {
+		// The room already writes to the socket, and a parked peer stays on the first room's waiting list
+		signalError(currentPeer, models.MessageTypeJoin, errAlreadyJoined)
+		return currentRoom, errAlreadyJoined
 	}
 	err := json.Unmarshal(data, &payload)
 	if err != nil {
 		logger.LogError("Error unmarshaling join data", "error", err)
 		return currentRoom, err
 	}
+	if err := setProfile(currentPeer, payload.DisplayName, payload.Metadata); err != nil {
+		logger.LogError("Invalid peer profile", "error", err)
+		signalSocket(conn, models.MessageTypeError, models.ErrorPayload{Event: models.MessageTypeJoin, Error: err.Error()})
+		return currentRoom, err
+	}
+	remoteIP := clientIP(req)
+	if err := h.authenticate(req, payload.Token, payload.RoomID, currentPeer); err != nil {
+		logger.LogError("Join refused by authentication", "error", err, "ip", remoteIP, "roomId", payload.RoomID)
+		signalSocket(conn, models.MessageTypeUnauthorized, err.Error())
+		return currentRoom, err
+	}
 	// Create or get the room
 	if r := h.Manager.GetRoom(payload.RoomID); r != nil {
+		if err := r.CheckWhitelist(currentPeer.UserID); err != nil {
+			logger.LogError("Join refused by whitelist", "userId", currentPeer.UserID.String(), "roomId", r.ID)
+			signalSocket(conn, models.MessageTypeAccessDenied, err.Error())
+			return currentRoom, err
+		}
+		if err := h.checkRoomPassword(conn, r, payload.Password, remoteIP); err != nil {
+			return currentRoom, err
+		}
 		currentRoom = r
 	} else {
-		h.Manager.CreateRoom(payload.RoomID, room.DefaultRoomCapacity, currentRoom)
+		if payload.Password != "" {
+			if err := currentRoom.SetPassword(payload.Password); err != nil {
+				logger.LogError("Error setting room password", "error", err, "roomId", payload.RoomID)
+				return currentRoom, err
+			}
+		}
+		if currentPeer.UserID != uuid.Nil {
+			currentRoom.SetCreator(currentPeer.UserID)
+		}
+		if payload.Private {
+			if err := currentRoom.SetPrivate(currentPeer.UserID); err != nil {
+				signalSocket(conn, models.MessageTypeAccessDenied, err.Error())
+				return currentRoom, err
+			}
+		}
+		capacity, err := h.Manager.ResolveCapacity(payload.Capacity)
+		if err != nil {
+			logger.LogError("Invalid room capacity requested", "capacity", payload.Capacity, "roomId", payload.RoomID)
+			return currentRoom, err
+		}
+		videoCodecs, err := h.Manager.ResolveVideoCodecs(payload.VideoCodecs)
+		if err != nil {
+			logger.LogError("Invalid room codecs requested", "error", err, "roomId", payload.RoomID)
+			signalSocket(conn, models.MessageTypeError, models.ErrorPayload{Event: models.MessageTypeJoin, Error: err.Error()})
+			return currentRoom, err
+		}
+		h.Manager.CreateRoom(payload.RoomID, capacity, currentRoom)
 		if !currentRoom.IsCreated() {
 			logger.LogError("Room creation failed", "roomId", payload.RoomID)
 			return currentRoom, errors.New("room creation failed")
 		}
+		if payload.SinglePresenter != nil {
+			currentRoom.SetSinglePresenter(*payload.SinglePresenter)
+		}
+		currentRoom.SetVideoCodecs(videoCodecs)
+	}
+	if currentRoom.IsLocked() && !currentRoom.BypassesLock(currentPeer) {
+		// Knock to enter, a moderator admits the peer later through the same socket
+		return currentRoom, currentRoom.ParkPeer(currentPeer.DisplayName, conn, currentPeer)
 	}
-	err = currentRoom.InitializePeer(payload.PeerID, nil, conn, currentPeer)
+	err = currentRoom.InitializePeer(payload.PeerID, currentPeer.DisplayName, conn, currentPeer)
 	if err != nil {
 		if errors.Is(err, room.ErrPeerExists) {
 			logger.LogError("Peer already exists in room", "peerId", payload.PeerID, "roomId", payload.RoomID)
@@ -135,10 +373,198 @@ func (h *WebSocketHandler) handleJoin(conn *websocket.Conn, data json.RawMessage
 		}
 		return currentRoom, err
 	}
-	currentRoom.SignalPeer(currentPeer, "peer-id", currentPeer.ID.String(), true)
-	currentRoom.AddTracksToPeer(currentPeer) // Should only add existing tracks to the new peer on join
-	logger.LogInfo("Peer joined room", "peerId", currentPeer.ID.String(), "roomId", currentRoom.ID)
-	logger.LogInfo("Current number of peers in room", "count", len(currentRoom.Peers))
-	fmt.Println("peer:", currentPeer)
+	h.completeJoin(currentRoom, currentPeer)
 	return currentRoom, nil
 }
+
+// completeJoin finishes joining a peer that was just added to the room, either directly or from the waiting list
+func (h *WebSocketHandler) completeJoin(currentRoom *room.Room, p *models.Peer) {
+	currentRoom.SignalPeer(p, models.MessageTypeCodecs, currentRoom.Codecs(), true) // Before peer-id, the client's offer follows it
+	currentRoom.SignalPeer(p, "peer-id", p.ID.String(), true)
+	currentRoom.AddTracksToPeer(p) // Should only add existing tracks to the new peer on join
+	currentRoom.AnnouncePeer(p)
+	currentRoom.BroadcastRoles() // Joining may have changed the owner (first or returning creator)
+	if history := currentRoom.RecentChat(); len(history) > 0 {
+		currentRoom.SignalPeer(p, models.MessageTypeChatHistory, history, true)
+	}
+	if currentRoom.IsModerator(p) {
+		for _, waiting := range currentRoom.WaitingPeers() {
+			currentRoom.SignalPeer(p, models.MessageTypeWaitingPeer, waiting, true)
+		}
+	}
+	logger.LogInfo("Peer joined room", "peerId", p.ID.String(), "roomId", currentRoom.ID)
+	logger.LogInfo("Current number of peers in room", "count", len(currentRoom.Peers))
+}
+
+// commandRoles lists the signaling commands restricted to moderators and the role each one needs
+var commandRoles = map[models.WebsocketMessageEvent]room.Role{
+	models.MessageTypeLockRoom:          room.RoleAdmin,
+	models.MessageTypeUnlockRoom:        room.RoleAdmin,
+	models.MessageTypeAdmit:             room.RoleAdmin,
+	models.MessageTypeDeny:              room.RoleAdmin,
+	models.MessageTypeWhitelistAdd:      room.RoleAdmin,
+	models.MessageTypeWhitelistRemove:   room.RoleAdmin,
+	models.MessageTypeKick:              room.RoleAdmin,
+	models.MessageTypeMutePeer:          room.RoleAdmin,
+	models.MessageTypeDisableVideo:      room.RoleAdmin,
+	models.MessageTypePromoteAdmin:      room.RoleOwner,
+	models.MessageTypeDemoteAdmin:       room.RoleOwner,
+	models.MessageTypeTransferOwnership: room.RoleOwner,
+}
+
+// authorize reports whether the peer holds the role a command needs, telling it off otherwise
+func (h *WebSocketHandler) authorize(currentRoom *room.Room, p *models.Peer, event models.WebsocketMessageEvent, required room.Role) bool {
+	if !p.IsCreated() || !currentRoom.IsCreated() {
+		logger.LogError("Moderation command received before join", "event", event)
+		return false
+	}
+	if role := currentRoom.RoleOf(p.ID); role < required {
+		logger.LogError("Moderation command refused", "event", event, "role", role.String(), "peerId", p.ID.String(), "roomId", currentRoom.ID)
+		if required == room.RoleOwner {
+			signalError(p, event, room.ErrNotOwner)
+		} else {
+			signalError(p, event, room.ErrNotModerator)
+		}
+		return false
+	}
+	return true
+}
+
+// parseTarget reads the peer a command is aimed at
+func parseTarget(data json.RawMessage) (uuid.UUID, error) {
+	var payload models.PeerTargetPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(payload.PeerID)
+}
+
+// signalError tells the peer that one of its requests failed
+func signalError(p *models.Peer, event models.WebsocketMessageEvent, err error) {
+	room.SignalPeer(p, models.MessageTypeError, models.ErrorPayload{Event: event, Error: err.Error()}, true)
+}
+
+// checkRoomPassword verifies the password of a protected room, rate limiting failures per IP and per
+// room. The attempt counts as a failure until the hash says otherwise. The per room limit caps
+// guessing spread over many addresses, at the price of also turning away the right password until
+// the window is over: that lockout is accepted, the per IP limit stays far below it.
+func (h *WebSocketHandler) checkRoomPassword(conn *websocket.Conn, target *room.Room, password string, remoteIP string) error {
+	if !target.HasPassword() {
+		return nil
+	}
+	wait := h.ipPasswordFailures.Reserve(remoteIP)
+	if wait == 0 {
+		if wait = h.roomPasswordFailures.Reserve(target.ID); wait > 0 {
+			h.ipPasswordFailures.Release(remoteIP)
+		}
+	}
+	if wait > 0 {
+		logger.LogError("Password attempt rejected by rate limit", "ip", remoteIP, "roomId", target.ID)
+		signalSocket(conn, models.MessageTypeAuthFailed, models.AuthFailedPayload{
+			Error:      errTooManyAttempts.Error(),
+			RetryAfter: int(wait.Seconds()) + 1,
+		})
+		return errTooManyAttempts
+	}
+
+	err := target.CheckPassword(password)
+	switch {
+	case errors.Is(err, room.ErrPasswordRequired):
+		h.ipPasswordFailures.Release(remoteIP)
+		h.roomPasswordFailures.Release(target.ID)
+		signalSocket(conn, models.MessageTypeAuthRequired, models.AuthFailedPayload{Error: err.Error()})
+		return err
+	case err != nil:
+		logger.LogError("Wrong room password", "ip", remoteIP, "roomId", target.ID)
+		signalSocket(conn, models.MessageTypeAuthFailed, models.AuthFailedPayload{Error: err.Error()})
+		return err
+	}
+	h.ipPasswordFailures.Reset(remoteIP)
+	h.roomPasswordFailures.Release(target.ID)
+	return nil
+}
+
+// setProfile validates and stores the name and metadata a peer joins with. The name
+// from a join token, set later by authenticate, takes precedence.
+func setProfile(p *models.Peer, displayName string, metadata map[string]string) error {
+	p.DisplayName = nil
+	if displayName != "" {
+		name, err := room.NormalizeDisplayName(displayName)
+		if err != nil {
+			return err
+		}
+		p.DisplayName = &name
+	}
+	if err := room.ValidateMetadata(metadata); err != nil {
+		return err
+	}
+	p.Metadata = metadata
+	return nil
+}
+
+// authenticate establishes who is joining before any room is touched. A join token (from the join
+// payload or the "token" query parameter) wins over the trusted proxy header, without either the
+// peer stays anonymous unless tokens are required.
+func (h *WebSocketHandler) authenticate(req *http.Request, token string, roomID string, p *models.Peer) error {
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	claims, err := h.Verifier.Verify(token)
+	if err != nil {
+		return err
+	}
+	if claims != nil {
+		if !claims.AllowsRoom(roomID) {
+			return auth.ErrRoomNotAllowed
+		}
+		p.UserID, _ = claims.UserID() // Verify made sure the subject parses
+		p.GrantedRole = claims.Role
+		if name, err := room.NormalizeDisplayName(claims.Name); err == nil {
+			p.DisplayName = &name
+		}
+		return nil
+	}
+	p.UserID = h.identify(req)
+	return nil
+}
+
+// identify returns the user named by the trusted proxy header, uuid.Nil for anonymous clients
+func (h *WebSocketHandler) identify(r *http.Request) uuid.UUID {
+	if h.Config.Auth.UserIDHeader == "" {
+		return uuid.Nil
+	}
+	value := r.Header.Get(h.Config.Auth.UserIDHeader)
+	if value == "" {
+		return uuid.Nil
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		logger.LogError("Invalid user id header", "header", h.Config.Auth.UserIDHeader, "error", err)
+		return uuid.Nil
+	}
+	return id
+}
+
+func isAuthError(err error) bool {
+	return errors.Is(err, room.ErrPasswordRequired) || errors.Is(err, room.ErrPasswordInvalid) || errors.Is(err, errTooManyAttempts)
+}
+
+// signalSocket writes to a socket that has no peer yet. Only the handler goroutine knows the
+// socket at that point, so there is no concurrent writer to guard against: handleJoin refuses a
+// second join once the socket belongs to a peer in a room or on its waiting list.
+func signalSocket(conn *websocket.Conn, event models.WebsocketMessageEvent, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(models.WebSocketMessage{Event: event, Data: payload})
+}
+
+// clientIP extracts the address of the remote end of the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
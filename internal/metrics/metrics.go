@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"expvar"
+)
+
+// Counters are published as JSON on /debug/vars of the admin listener (server.metricsAddr), never
+// on the public one: expvar registers itself on http.DefaultServeMux, which the server doesn't serve
+
+var (
+	RejectedOrigins = expvar.NewInt("websocket_rejected_origins")
+
+	DataChannelRelayed = expvar.NewInt("datachannel_messages_relayed")
+	DataChannelDropped = expvar.NewInt("datachannel_messages_dropped") // Over the sender's rate limit or target channel not open
+)
+
+var (
+	NacksReceived        = expvar.NewInt("rtp_nacks_received")        // Packets subscribers reported lost
+	PacketsRetransmitted = expvar.NewInt("rtp_packets_retransmitted") // Answered from the packet cache
+	RetransmitMisses     = expvar.NewInt("rtp_retransmit_misses")     // No longer in the cache
+	NacksSent            = expvar.NewInt("rtp_nacks_sent")            // Packets asked for again from publishers
+
+	KeyframeRequests          = expvar.NewInt("rtp_keyframe_requests")           // PLIs sent to publishers
+	KeyframeRequestsThrottled = expvar.NewInt("rtp_keyframe_requests_throttled") // Merged into another one
+)
@@ -3,11 +3,14 @@ package models
 import (
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
+	"video_conferencing_server/internal/sfu"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
 )
 
 type WebsocketMessageEvent string
@@ -18,6 +21,67 @@ const (
 	MessageTypeJoin         WebsocketMessageEvent = "join"
 	MessageTypeIceCandidate WebsocketMessageEvent = "iceCandidate"
 	MessageTypeLeave        WebsocketMessageEvent = "leave"
+	MessageTypeRoomFull     WebsocketMessageEvent = "room-full"
+
+	// Waiting room
+	MessageTypeLockRoom           WebsocketMessageEvent = "lock-room"
+	MessageTypeUnlockRoom         WebsocketMessageEvent = "unlock-room"
+	MessageTypeRoomLocked         WebsocketMessageEvent = "room-locked"
+	MessageTypeWaiting            WebsocketMessageEvent = "waiting"
+	MessageTypeWaitingPeer        WebsocketMessageEvent = "waiting-peer"
+	MessageTypeWaitingPeerRemoved WebsocketMessageEvent = "waiting-peer-removed"
+	MessageTypeAdmit              WebsocketMessageEvent = "admit"
+	MessageTypeDeny               WebsocketMessageEvent = "deny"
+	MessageTypeDenied             WebsocketMessageEvent = "denied"
+	MessageTypeError              WebsocketMessageEvent = "error"
+
+	// Password protected rooms
+	MessageTypeAuthRequired WebsocketMessageEvent = "auth-required"
+	MessageTypeAuthFailed   WebsocketMessageEvent = "auth-failed"
+	MessageTypeUnauthorized WebsocketMessageEvent = "unauthorized"
+
+	// Private rooms
+	MessageTypeWhitelistAdd    WebsocketMessageEvent = "whitelist-add"
+	MessageTypeWhitelistRemove WebsocketMessageEvent = "whitelist-remove"
+	MessageTypeWhitelist       WebsocketMessageEvent = "whitelist"
+	MessageTypeAccessDenied    WebsocketMessageEvent = "access-denied"
+	MessageTypeEvicted         WebsocketMessageEvent = "evicted"
+
+	// Roles
+	MessageTypePromoteAdmin      WebsocketMessageEvent = "promote-admin"
+	MessageTypeDemoteAdmin       WebsocketMessageEvent = "demote-admin"
+	MessageTypeTransferOwnership WebsocketMessageEvent = "transfer-ownership"
+	MessageTypeRolesChanged      WebsocketMessageEvent = "roles-changed"
+
+	// Moderation
+	MessageTypeKick         WebsocketMessageEvent = "kick"
+	MessageTypeMutePeer     WebsocketMessageEvent = "mute-peer"
+	MessageTypeDisableVideo WebsocketMessageEvent = "disable-video"
+	MessageTypeModeration   WebsocketMessageEvent = "moderation"
+
+	// Participants
+	MessageTypePeerJoined  WebsocketMessageEvent = "peer-joined"
+	MessageTypePeerUpdated WebsocketMessageEvent = "peer-updated"
+	MessageTypePeerLeft    WebsocketMessageEvent = "peer-left"
+	MessageTypeRoster      WebsocketMessageEvent = "roster"
+	MessageTypeGetRoster   WebsocketMessageEvent = "get-roster"
+	MessageTypeMediaState  WebsocketMessageEvent = "media-state"
+
+	// Chat
+	MessageTypeChat        WebsocketMessageEvent = "chat"
+	MessageTypeChatHistory WebsocketMessageEvent = "chat-history"
+
+	// Media forwarding
+	MessageTypeSetLayer         WebsocketMessageEvent = "set-layer"
+	MessageTypeGetStats         WebsocketMessageEvent = "get-stats"
+	MessageTypeStats            WebsocketMessageEvent = "stats"
+	MessageTypeCodecs           WebsocketMessageEvent = "codecs"
+	MessageTypeCodecUnsupported WebsocketMessageEvent = "codec-unsupported"
+
+	// Screen sharing
+	MessageTypeShareStart       WebsocketMessageEvent = "share-start"
+	MessageTypeShareStop        WebsocketMessageEvent = "share-stop"
+	MessageTypePresenterChanged WebsocketMessageEvent = "presenter-changed"
 )
 
 type WebSocketMessage struct {
@@ -31,29 +95,219 @@ type Candidate struct {
 	SDPMLineIndex uint16 `json:"sdpMLineIndex"`
 }
 
+type RoomFullPayload struct {
+	Error     string `json:"error"`
+	Capacity  int    `json:"capacity"`
+	Occupancy int    `json:"occupancy"`
+}
+
+type ErrorPayload struct {
+	Event WebsocketMessageEvent `json:"event"` // The request that failed
+	Error string                `json:"error"`
+}
+
+type PeerTargetPayload struct {
+	PeerID string `json:"peerId"`
+}
+
+type WaitingPeerPayload struct {
+	PeerID      string  `json:"peerId"`
+	DisplayName *string `json:"displayName"`
+}
+
+type AuthFailedPayload struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retryAfter,omitempty"` // Seconds until another attempt is accepted
+}
+
+type UserTargetPayload struct {
+	UserID string `json:"userId"`
+}
+
+type WhitelistPayload struct {
+	UserIDs []string `json:"userIds"`
+}
+
+type RolesPayload struct {
+	Version uint64   `json:"version"` // Roster version, see RosterPayload
+	Owner   string   `json:"owner"`
+	Admins  []string `json:"admins"`
+}
+
+type ModerationPayload struct {
+	PeerID string `json:"peerId"`
+	Revert bool   `json:"revert"` // Lifts a previous mute-peer/disable-video
+	Reason string `json:"reason"`
+}
+
+// ModerationEventPayload tells the room what a moderator did and to whom
+type ModerationEventPayload struct {
+	Action string `json:"action"` // "kick", "mute", "unmute", "disable-video" or "enable-video"
+	PeerID string `json:"peerId"`
+	By     string `json:"by"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PeerInfo is how a participant is presented to everyone else in the room
+type PeerInfo struct {
+	PeerID         string            `json:"peerId"`
+	DisplayName    *string           `json:"displayName"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	StreamID       string            `json:"streamId"` // Tracks forwarded from this peer belong to this MediaStream
+	Role           string            `json:"role"`
+	JoinedAt       time.Time         `json:"joinedAt"`
+	AudioMuted     bool              `json:"audioMuted"` // Muted by the peer or a moderator
+	VideoOff       bool              `json:"videoOff"`   // Turned off by the peer or a moderator
+	ScreenSharing  bool              `json:"screenSharing"`
+	ScreenStreamID string            `json:"screenStreamId,omitempty"` // MediaStream of the screen share while ScreenSharing
+
+	AudioForceMuted    bool `json:"audioForceMuted"`
+	VideoForceDisabled bool `json:"videoForceDisabled"`
+}
+
+// MediaStatePayload is what a client reports about its own media, screen sharing is
+// announced separately (share-start/share-stop)
+type MediaStatePayload struct {
+	AudioMuted bool `json:"audioMuted"`
+	VideoOff   bool `json:"videoOff"`
+}
+
+// LayerRequestPayload asks for a simulcast layer of another peer's video, TrackID picks one of
+// its tracks (as seen by the subscriber), empty means all of them
+type LayerRequestPayload struct {
+	PeerID  string `json:"peerId"`
+	TrackID string `json:"trackId"`
+	Layer   string `json:"layer"` // "low", "mid" or "high"
+}
+
+// CodecsPayload tells a joining client the codecs the room allows, most preferred first
+type CodecsPayload struct {
+	Video []string `json:"video"`
+	Audio []string `json:"audio"`
+}
+
+// CodecUnsupportedPayload tells a subscriber why it doesn't receive one of another peer's tracks
+type CodecUnsupportedPayload struct {
+	PeerID  string `json:"peerId"`
+	TrackID string `json:"trackId"`
+	Codec   string `json:"codec"`
+	Error   string `json:"error"`
+}
+
+// StatsPayload answers get-stats with what the client reported receiving each track
+type StatsPayload struct {
+	Tracks []TrackStats `json:"tracks"`
+}
+
+type TrackStats struct {
+	PeerID       string     `json:"peerId"`
+	TrackID      string     `json:"trackId"`
+	Kind         string     `json:"kind"`
+	Layer        string     `json:"layer"`        // Simulcast RID or VP9/AV1 spatial and temporal layers (S1T2) being received, empty for a single plain layer
+	FractionLost float64    `json:"fractionLost"` // Since the previous report, 0 to 1
+	PacketsLost  uint32     `json:"packetsLost"`
+	JitterMs     float64    `json:"jitterMs"`
+	RTTMs        float64    `json:"rttMs"`
+	UpdatedAt    *time.Time `json:"updatedAt,omitempty"` // Missing until the client sent a report
+}
+
+// ShareStartPayload names the tracks the client is about to publish as its screen share,
+// it is sent before the tracks are added so the server can tell them from the camera
+type ShareStartPayload struct {
+	TrackIDs []string `json:"trackIds"`
+}
+
+// PresenterPayload is sent with presenter-changed, PeerID is empty when nobody is presenting
+type PresenterPayload struct {
+	PeerID   string `json:"peerId"`
+	StreamID string `json:"streamId,omitempty"`
+}
+
+// RosterPayload is the full roster, sent in answer to get-roster
+type RosterPayload struct {
+	// Every roster change bumps the room's roster version by one and the event announcing it
+	// carries the new version, a client that sees a gap has missed an update and asks for the
+	// full roster again (get-roster)
+	Version   uint64     `json:"version"`
+	Peers     []PeerInfo `json:"peers"`
+	Presenter string     `json:"presenter,omitempty"`
+}
+
+// RosterUpdatePayload is sent with peer-joined and peer-updated
+type RosterUpdatePayload struct {
+	Version uint64   `json:"version"`
+	Peer    PeerInfo `json:"peer"`
+}
+
+type PeerLeftPayload struct {
+	Version uint64 `json:"version"`
+	PeerID  string `json:"peerId"`
+}
+
+// ChatRequest is a chat message as sent by a client
+type ChatRequest struct {
+	Text string `json:"text"`
+	To   string `json:"to,omitempty"` // Peer ID for a private message, empty for the whole room
+}
+
+// ChatMessage is a chat message as the server relays and stores it
+type ChatMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	FromName *string   `json:"fromName"`
+	To       string    `json:"to,omitempty"`
+	Text     string    `json:"text"`
+	SentAt   time.Time `json:"sentAt"`
+}
+
+type RoomLockedPayload struct {
+	Locked bool `json:"locked"`
+}
+
 type AccessDetails struct {
-	Private   bool // This will affect whether we check the whitelist
-	Locked    bool
-	Password  *string
-	Whitelist []uuid.UUID
+	Private      bool // This will affect whether we check the whitelist
+	Locked       bool
+	PasswordHash []byte // argon2id of the password with PasswordSalt, nil when the room is open
+	PasswordSalt []byte
+	Whitelist    []uuid.UUID
 }
 
 type ManagementDetails struct {
-	Owner     uuid.UUID
-	Admin     []uuid.UUID
+	Owner     uuid.UUID   // Peer ID of the owner
+	Admin     []uuid.UUID // Peer IDs of the admins
+	Creator   uuid.UUID   // User ID of the authenticated creator, if any
 	CreatedAt time.Time
 }
 
 type Peer struct {
-	ID                   uuid.UUID
+	ID                   uuid.UUID // Per connection, minted by the server
+	UserID               uuid.UUID // Authenticated identity, uuid.Nil for anonymous peers
+	GrantedRole          string    // Room role granted by the join token ("owner", "admin"), empty otherwise
 	DisplayName          *string
+	Metadata             map[string]string // Small client supplied details (avatar URL, role label, ...)
 	PeerConnection       *webrtc.PeerConnection
-	Tracks               []*webrtc.TrackLocalStaticRTP
+	Publications         map[string]*sfu.Publication  // What the peer publishes, by remote track id
+	Senders              map[string]*webrtc.RTPSender // What the peer receives, by publisher id and track id
+	Codecs               []string                     // MIME types the peer can receive, from its offer, guarded by TrackLock
+	TrackLock            sync.RWMutex                 // Guards Publications, Senders, Codecs and ScreenTrackIDs
+	Allocator            *sfu.Allocator               // Shares the peer's downlink between the tracks it receives
+	AudioLevel           atomic.Int32                 // Smoothed loudness of the peer's microphone, see room.recordAudioLevel
 	WebSocket            *websocket.Conn
 	SocketLock           sync.Mutex
 	SignalLock           sync.Mutex
 	RenegotiationPending bool
 	IsNegotiating        bool
+	JoinedAt             time.Time
+	AudioMuted           atomic.Bool                    // Reported by the client (media-state)
+	VideoOff             atomic.Bool                    // Reported by the client (media-state)
+	ScreenSharing        atomic.Bool                    // Set by share-start/share-stop
+	ScreenTrackIDs       []string                       // Remote track ids of the screen share, guarded by TrackLock
+	AudioForceMuted      atomic.Bool                    // Set by a moderator, the SFU stops forwarding the peer's audio
+	VideoForceDisabled   atomic.Bool                    // Set by a moderator, the SFU stops forwarding the peer's video
+	DataChannels         map[string]*webrtc.DataChannel // Server side end of the peer's data channels, by label
+	DataChannelLock      sync.Mutex
+	DataMessageLimiter   *rate.Limiter // Relay budget in messages per second
+	DataByteLimiter      *rate.Limiter // Relay budget in bytes per second
 	// RoomID         string
 	Done chan bool
 }
@@ -0,0 +1,195 @@
+package room
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+const MaxPasswordLength = 256
+
+var (
+	ErrPasswordRequired = errors.New("this room requires a password")
+	ErrPasswordInvalid  = errors.New("wrong room password")
+	ErrPasswordTooLong  = errors.New("room password is too long")
+	ErrNotWhitelisted   = errors.New("this room is private and you are not on its whitelist")
+	ErrAnonymousPrivate = errors.New("private rooms require an authenticated user")
+)
+
+// argon2id parameters, the OWASP recommendation of 19 MiB: a room password only guards a meeting
+// and every join attempt pays for a hash
+const (
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+	passwordTime       = 2
+	passwordMemory     = 19 * 1024
+	passwordThreads    = 1
+)
+
+// At most this many hashes run at once, the others wait, so a burst of join attempts can't
+// allocate more than maxConcurrentHashes*passwordMemory
+const maxConcurrentHashes = 4
+
+var hashSlots = make(chan struct{}, maxConcurrentHashes)
+
+func hashPassword(password string, salt []byte) []byte {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	return argon2.IDKey([]byte(password), salt, passwordTime, passwordMemory, passwordThreads, passwordKeyLength)
+}
+
+// SetPassword protects the room with the given password, only its salted hash is kept
+func (r *Room) SetPassword(password string) error {
+	if len(password) > MaxPasswordLength {
+		return ErrPasswordTooLong
+	}
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash := hashPassword(password, salt)
+
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if r.AccessDetails == nil {
+		r.AccessDetails = &models.AccessDetails{}
+	}
+	r.AccessDetails.PasswordSalt = salt
+	r.AccessDetails.PasswordHash = hash
+	return nil
+}
+
+// HasPassword reports whether joining the room requires a password
+func (r *Room) HasPassword() bool {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return r.AccessDetails != nil && r.AccessDetails.PasswordHash != nil
+}
+
+// CheckPassword verifies a join attempt against the room password in constant time
+func (r *Room) CheckPassword(password string) error {
+	r.ListLock.RLock()
+	if r.AccessDetails == nil || r.AccessDetails.PasswordHash == nil {
+		r.ListLock.RUnlock()
+		return nil
+	}
+	salt, want := r.AccessDetails.PasswordSalt, r.AccessDetails.PasswordHash
+	r.ListLock.RUnlock()
+
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	if len(password) > MaxPasswordLength {
+		return ErrPasswordInvalid
+	}
+	if subtle.ConstantTimeCompare(hashPassword(password, salt), want) != 1 {
+		return ErrPasswordInvalid
+	}
+	return nil
+}
+
+// SetPrivate restricts the room to whitelisted users, starting with its creator
+func (r *Room) SetPrivate(creator uuid.UUID) error {
+	if creator == uuid.Nil {
+		return ErrAnonymousPrivate
+	}
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if r.AccessDetails == nil {
+		r.AccessDetails = &models.AccessDetails{}
+	}
+	r.AccessDetails.Private = true
+	r.AccessDetails.Whitelist = []uuid.UUID{creator}
+	return nil
+}
+
+// CheckWhitelist verifies that the user may join, public rooms admit everyone
+func (r *Room) CheckWhitelist(userID uuid.UUID) error {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	if r.AccessDetails == nil || !r.AccessDetails.Private {
+		return nil
+	}
+	if userID == uuid.Nil {
+		return ErrAnonymousPrivate
+	}
+	if !slices.Contains(r.AccessDetails.Whitelist, userID) {
+		return ErrNotWhitelisted
+	}
+	return nil
+}
+
+// Whitelist returns a copy of the users allowed into the room
+func (r *Room) Whitelist() []uuid.UUID {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	if r.AccessDetails == nil {
+		return nil
+	}
+	return slices.Clone(r.AccessDetails.Whitelist)
+}
+
+// AddToWhitelist allows the user into the room
+func (r *Room) AddToWhitelist(userID uuid.UUID) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if !slices.Contains(r.AccessDetails.Whitelist, userID) {
+		r.AccessDetails.Whitelist = append(r.AccessDetails.Whitelist, userID)
+	}
+}
+
+// RemoveFromWhitelist takes the user off the whitelist and, in a private room, evicts every
+// connection (joined or waiting) that belongs to it right away. As with a kick, the actor has to
+// outrank all of the user's joined peers, and the owner's and the creator's user can't be removed.
+func (r *Room) RemoveFromWhitelist(actor, userID uuid.UUID) error {
+	r.ListLock.Lock()
+	if md := r.ManagementDetails; md != nil && md.Creator != uuid.Nil && md.Creator == userID {
+		r.ListLock.Unlock()
+		return ErrTargetIsOwner
+	}
+	for _, p := range r.Peers {
+		if p.UserID != userID {
+			continue
+		}
+		if r.roleOf(p.ID) == RoleOwner {
+			r.ListLock.Unlock()
+			return ErrTargetIsOwner
+		}
+		if r.roleOf(p.ID) >= r.roleOf(actor) {
+			r.ListLock.Unlock()
+			return ErrTargetOutranks
+		}
+	}
+	r.AccessDetails.Whitelist = slices.DeleteFunc(r.AccessDetails.Whitelist, func(id uuid.UUID) bool {
+		return id == userID
+	})
+	private := r.AccessDetails.Private
+	var evicted []*models.Peer
+	if private {
+		for _, p := range r.Peers {
+			if p.UserID == userID {
+				evicted = append(evicted, p)
+			}
+		}
+		for _, p := range r.WaitingList {
+			if p.UserID == userID {
+				evicted = append(evicted, p)
+			}
+		}
+	}
+	r.ListLock.Unlock()
+
+	for _, p := range evicted {
+		SignalPeer(p, models.MessageTypeEvicted, ErrNotWhitelisted.Error(), true)
+		r.RemovePeer(p)
+		p.WebSocket.Close()
+		logger.LogInfo("Peer evicted from private room", "peerId", p.ID.String(), "userId", userID.String(), "by", actor.String(), "roomId", r.ID)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package room
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestRemoveFromWhitelistRanks(t *testing.T) {
+	owner, admin, other, participant := newTestPeer(), newTestPeer(), newTestPeer(), newTestPeer()
+	creator := uuid.New()
+	for _, p := range []*models.Peer{owner, admin, other, participant} {
+		p.UserID = uuid.New()
+	}
+	tests := []struct {
+		name   string
+		actor  *models.Peer
+		userID uuid.UUID
+		err    error
+	}{
+		{name: "admin removes a participant", actor: admin, userID: participant.UserID},
+		{name: "admin removes a user not in the room", actor: admin, userID: uuid.New()},
+		{name: "admin removes the owner", actor: admin, userID: owner.UserID, err: ErrTargetIsOwner},
+		{name: "owner removes themselves", actor: owner, userID: owner.UserID, err: ErrTargetIsOwner},
+		{name: "admin removes the creator", actor: admin, userID: creator, err: ErrTargetIsOwner},
+		{name: "admin removes another admin", actor: admin, userID: other.UserID, err: ErrTargetOutranks},
+		{name: "admin removes themselves", actor: admin, userID: admin.UserID, err: ErrTargetOutranks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Room{
+				ID:                "room",
+				Peers:             make(map[uuid.UUID]*models.Peer),
+				AccessDetails:     &models.AccessDetails{Whitelist: []uuid.UUID{creator, tt.userID}}, // Public, nobody is evicted
+				ManagementDetails: &models.ManagementDetails{Owner: owner.ID, Admin: []uuid.UUID{admin.ID, other.ID}, Creator: creator},
+			}
+			for _, p := range []*models.Peer{owner, admin, other, participant} {
+				r.Peers[p.ID] = p
+			}
+			if err := r.RemoveFromWhitelist(tt.actor.ID, tt.userID); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if removed := !slices.Contains(r.Whitelist(), tt.userID); removed != (tt.err == nil) {
+				t.Fatalf("removed from the whitelist: %v with err %v", removed, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package room
+
+import (
+	"time"
+	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+
+	"github.com/pion/interceptor/pkg/cc"
+)
+
+// Layers are re-allocated this often, and right away when the estimate drops by more than a fifth
+const allocationInterval = time.Second
+
+// Publication priorities for the allocator, higher gets the bandwidth first
+const (
+	priorityDefault = iota
+	prioritySpeaker
+	priorityScreen
+)
+
+// watchEstimator feeds a subscriber's congestion controller into its allocator
+func (r *Room) watchEstimator(p *models.Peer, estimator cc.BandwidthEstimator) {
+	allocator := p.Allocator
+	allocator.SetEstimate(estimator.GetTargetBitrate())
+	estimator.OnTargetBitrateChange(func(bitrate int) {
+		previous := allocator.Budget()
+		allocator.SetEstimate(bitrate)
+		if bitrate < previous*4/5 {
+			allocator.Allocate(r.trackPriority())
+		}
+	})
+}
+
+// runAllocator re-evaluates the layers a peer receives until it leaves
+func (r *Room) runAllocator(p *models.Peer) {
+	ticker := time.NewTicker(allocationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.Allocator.Allocate(r.trackPriority())
+		case <-p.Done:
+			return
+		}
+	}
+}
+
+// trackPriority ranks publications for the allocator: screen shares first, then the active speaker
+func (r *Room) trackPriority() func(*sfu.Publication) int {
+	speaker := r.activeSpeaker().String()
+	return func(publication *sfu.Publication) int {
+		switch {
+		case publication.Screen:
+			return priorityScreen
+		case publication.PublisherID == speaker:
+			return prioritySpeaker
+		}
+		return priorityDefault
+	}
+}
@@ -0,0 +1,75 @@
+package room
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrChatEmpty   = errors.New("chat message is empty")
+	ErrChatTooLong = errors.New("chat message is too long")
+)
+
+// SendChat stamps a message with its sender and the server time and delivers it. Room-wide
+// messages go to everyone and into the history, private ones only to the recipient and the sender.
+func (r *Room) SendChat(from *models.Peer, request models.ChatRequest) error {
+	text := strings.TrimSpace(request.Text)
+	if text == "" {
+		return ErrChatEmpty
+	}
+	if utf8.RuneCountInString(text) > r.Config.Rooms.ChatMaxLength {
+		return ErrChatTooLong
+	}
+
+	message := models.ChatMessage{
+		ID:       uuid.NewString(),
+		From:     from.ID.String(),
+		FromName: from.DisplayName,
+		Text:     text,
+		SentAt:   time.Now().UTC(),
+	}
+
+	if request.To != "" {
+		to, err := uuid.Parse(request.To)
+		if err != nil {
+			return err
+		}
+		r.ListLock.RLock()
+		recipient, ok := r.Peers[to]
+		r.ListLock.RUnlock()
+		if !ok {
+			return ErrPeerNotInRoom
+		}
+		message.To = to.String()
+		SignalPeer(recipient, models.MessageTypeChat, message, true)
+		if recipient.ID != from.ID {
+			SignalPeer(from, models.MessageTypeChat, message, true)
+		}
+		return nil
+	}
+
+	// Appending and fanning out under the same lock keeps the history in delivery order
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if size := r.Config.Rooms.ChatHistorySize; size > 0 {
+		r.ChatHistory = append(r.ChatHistory, message)
+		if len(r.ChatHistory) > size {
+			r.ChatHistory = slices.Clone(r.ChatHistory[len(r.ChatHistory)-size:])
+		}
+	}
+	r.fanOut(models.MessageTypeChat, message, uuid.Nil)
+	return nil
+}
+
+// RecentChat returns the stored room-wide messages
+func (r *Room) RecentChat() []models.ChatMessage {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return slices.Clone(r.ChatHistory)
+}
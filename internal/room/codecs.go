@@ -0,0 +1,119 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"video_conferencing_server/internal/config"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrCodecUnsupported = errors.New("the receiving browser cannot decode this codec")
+
+// SetVideoCodecs changes the video codecs the room negotiates, see Manager.ResolveVideoCodecs. It
+// only affects connections made later, so it is meant for the room creator's join.
+func (r *Room) SetVideoCodecs(codecs []string) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	r.VideoCodecs = codecs
+}
+
+// Codecs returns the codecs the room's connections negotiate, most preferred first
+func (r *Room) Codecs() models.CodecsPayload {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return models.CodecsPayload{Video: slices.Clone(r.VideoCodecs), Audio: slices.Clone(r.Config.WebRTC.Codecs.Audio)}
+}
+
+func (r *Room) codecConfig() config.CodecConfig {
+	codecs := r.Codecs()
+	return config.CodecConfig{Video: codecs.Video, Audio: codecs.Audio}
+}
+
+// recordCodecs remembers what the peer can receive, going by the codecs its offer lists for each
+// media section. Kinds the offer has no section for stay unknown.
+func recordCodecs(p *models.Peer, offer webrtc.SessionDescription) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return
+	}
+	var codecs []string
+	for _, media := range parsed.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			var payloadType uint8
+			if _, err := fmt.Sscan(format, &payloadType); err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(payloadType)
+			if err != nil {
+				continue
+			}
+			if mimeType := kind + "/" + codec.Name; !slices.ContainsFunc(codecs, func(c string) bool { return strings.EqualFold(c, mimeType) }) {
+				codecs = append(codecs, mimeType)
+			}
+		}
+	}
+
+	p.TrackLock.Lock()
+	defer p.TrackLock.Unlock()
+	p.Codecs = codecs
+}
+
+// canReceive reports whether the peer can decode a publication's codec, peers that haven't told
+// yet get the benefit of the doubt. The caller holds the peer's TrackLock.
+func canReceive(p *models.Peer, publication *sfu.Publication) bool {
+	kind := publication.Kind.String() + "/"
+	known := false
+	for _, codec := range p.Codecs {
+		if strings.EqualFold(codec, publication.Codec.MimeType) {
+			return true
+		}
+		known = known || strings.HasPrefix(codec, kind)
+	}
+	return !known
+}
+
+// dropUndecodable unsubscribes the peer from the publications it turned out not to be able to
+// decode. It runs between taking the peer's offer and answering it, so the answer already leaves
+// them out.
+func (r *Room) dropUndecodable(p *models.Peer) {
+	for _, publisher := range r.otherPeers(p) {
+		publisher.TrackLock.RLock()
+		publications := make([]*sfu.Publication, 0, len(publisher.Publications))
+		for _, publication := range publisher.Publications {
+			publications = append(publications, publication)
+		}
+		publisher.TrackLock.RUnlock()
+
+		for _, publication := range publications {
+			p.TrackLock.RLock()
+			ok := canReceive(p, publication)
+			p.TrackLock.RUnlock()
+			if !ok && publication.DownTrack(p.ID.String()) != nil {
+				r.unsubscribe(p, publisher, publication)
+				r.signalUnsupported(p, publisher, publication)
+			}
+		}
+	}
+}
+
+// signalUnsupported tells the subscriber it won't receive a track it can't decode
+func (r *Room) signalUnsupported(subscriber, publisher *models.Peer, publication *sfu.Publication) {
+	logger.LogInfo("Subscriber cannot decode track", "toPeerId", subscriber.ID.String(), "fromPeerId", publisher.ID.String(),
+		"trackId", publication.TrackID, "codec", publication.Codec.MimeType, "roomId", r.ID)
+	r.SignalPeer(subscriber, models.MessageTypeCodecUnsupported, models.CodecUnsupportedPayload{
+		PeerID:  publisher.ID.String(),
+		TrackID: publication.TrackID,
+		Codec:   publication.Codec.MimeType,
+		Error:   ErrCodecUnsupported.Error(),
+	}, true)
+}
@@ -0,0 +1,137 @@
+package room
+
+import (
+	"time"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/metrics"
+	"video_conferencing_server/internal/models"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
+)
+
+// Data channels are relayed by label: a message a peer sends on "whiteboard" is delivered on the
+// "whiteboard" channel of every other peer in the room. Relayed messages are prefixed with the
+// sender's peer id (36 characters, canonical UUID form) and keep their text/binary type.
+
+// resetDataChannels forgets the peer's data channels and gives it full relay budgets, from the configured
+// message and byte rates
+func (r *Room) resetDataChannels(p *models.Peer) {
+	limits := r.Config.WebRTC.DataChannels
+	p.DataChannelLock.Lock()
+	p.DataChannels = make(map[string]*webrtc.DataChannel)
+	p.DataChannelLock.Unlock()
+	p.DataMessageLimiter = rate.NewLimiter(rate.Limit(limits.MaxMessagesPerSecond), limits.MaxMessagesPerSecond)
+	p.DataByteLimiter = rate.NewLimiter(rate.Limit(limits.MaxBytesPerSecond), limits.MaxBytesPerSecond)
+}
+
+// acceptDataChannel registers a channel opened by the peer and starts relaying what it receives
+func (r *Room) acceptDataChannel(p *models.Peer, dc *webrtc.DataChannel) {
+	p.DataChannelLock.Lock()
+	defer p.DataChannelLock.Unlock()
+
+	if existing, ok := p.DataChannels[dc.Label()]; ok && existing != dc {
+		// Both ends opened the same label, keep ours so relayed messages go on a single channel
+		logger.Logger.Warn("Duplicate data channel label, relaying on the first one", "label", dc.Label(), "peerId", p.ID.String())
+	} else {
+		p.DataChannels[dc.Label()] = dc
+	}
+	r.watchDataChannel(p, dc)
+}
+
+// watchDataChannel relays incoming messages and forgets the channel once it closes
+func (r *Room) watchDataChannel(p *models.Peer, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		r.relayData(p, dc.Label(), msg)
+	})
+	dc.OnClose(func() {
+		p.DataChannelLock.Lock()
+		if p.DataChannels[dc.Label()] == dc {
+			delete(p.DataChannels, dc.Label())
+		}
+		p.DataChannelLock.Unlock()
+	})
+}
+
+// relayData forwards a message to every other peer, within the sender's rate limits
+func (r *Room) relayData(from *models.Peer, label string, msg webrtc.DataChannelMessage) {
+	now := time.Now()
+	if !from.DataMessageLimiter.AllowN(now, 1) || !from.DataByteLimiter.AllowN(now, len(msg.Data)) {
+		metrics.DataChannelDropped.Add(1)
+		return
+	}
+
+	r.ListLock.RLock()
+	source, ok := r.Peers[from.ID]
+	targets := make([]*models.Peer, 0, len(r.Peers))
+	for _, peer := range r.Peers {
+		if peer.ID != from.ID {
+			targets = append(targets, peer)
+		}
+	}
+	r.ListLock.RUnlock()
+	if !ok || source != from {
+		return // Left the room, the channel is about to close
+	}
+
+	from.DataChannelLock.Lock()
+	like := from.DataChannels[label]
+	from.DataChannelLock.Unlock()
+	if like == nil {
+		return
+	}
+
+	payload := append([]byte(from.ID.String()), msg.Data...)
+	for _, to := range targets {
+		dc, err := r.dataChannelFor(to, like)
+		if err != nil {
+			logger.LogError("Error creating relay data channel", "error", err, "label", label, "toPeerId", to.ID.String())
+			continue
+		}
+		if dc.ReadyState() != webrtc.DataChannelStateOpen {
+			metrics.DataChannelDropped.Add(1)
+			continue // Still opening, the messages it misses are not replayed
+		}
+		if msg.IsString {
+			err = dc.SendText(string(payload))
+		} else {
+			err = dc.Send(payload)
+		}
+		if err != nil {
+			logger.LogError("Error relaying data channel message", "error", err, "label", label, "toPeerId", to.ID.String())
+			continue
+		}
+		metrics.DataChannelRelayed.Add(1)
+	}
+}
+
+// dataChannelFor returns the peer's channel with the same label as like, creating it with the
+// same delivery guarantees (ordering, retransmits, lifetime) if the peer never opened one
+func (r *Room) dataChannelFor(p *models.Peer, like *webrtc.DataChannel) (*webrtc.DataChannel, error) {
+	p.DataChannelLock.Lock()
+	if dc, ok := p.DataChannels[like.Label()]; ok {
+		p.DataChannelLock.Unlock()
+		return dc, nil
+	}
+	ordered := like.Ordered()
+	protocol := like.Protocol()
+	dc, err := p.PeerConnection.CreateDataChannel(like.Label(), &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxPacketLifeTime: like.MaxPacketLifeTime(),
+		MaxRetransmits:    like.MaxRetransmits(),
+		Protocol:          &protocol,
+	})
+	if err != nil {
+		p.DataChannelLock.Unlock()
+		return nil, err
+	}
+	first := len(p.DataChannels) == 0
+	p.DataChannels[like.Label()] = dc
+	r.watchDataChannel(p, dc)
+	p.DataChannelLock.Unlock()
+
+	if first && p.PeerConnection.SCTP().State() != webrtc.SCTPTransportStateConnected {
+		r.AttemptRenegotiation(p) // The session has no SCTP association yet, offer one
+	}
+	return dc, nil
+}
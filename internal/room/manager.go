@@ -1,15 +1,20 @@
 package room
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+	"video_conferencing_server/internal/config"
 	"video_conferencing_server/internal/logger"
 	"video_conferencing_server/internal/models"
 
 	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
 )
 
-const DefaultRoomCapacity = 50
-
 type Room struct {
 	ID                string
 	ListLock          sync.RWMutex
@@ -18,18 +23,71 @@ type Room struct {
 	AccessDetails     *models.AccessDetails
 	WaitingList       []*models.Peer
 	Capacity          int
+	RTCConfig         webrtc.Configuration
+	Config            *config.Config
+	RosterVersion     uint64               // Bumped on every change to who is in the room or how they appear, guarded by ListLock
+	ChatHistory       []models.ChatMessage // The latest room-wide messages, guarded by ListLock
+	SinglePresenter   bool                 // Only one peer may share its screen at a time
+	Presenter         uuid.UUID            // Latest peer to start a screen share, guarded by ListLock
+	VideoCodecs       []string             // Negotiated video codecs, most preferred first, guarded by ListLock
 }
 
 type Manager struct {
 	rooms     map[string]*Room
 	roomsLock sync.RWMutex
+	config    *config.Config
 }
 
 // NewManager creates and returns a new Room Manager instance
-func NewManager() *Manager {
+func NewManager(cfg *config.Config) *Manager {
 	return &Manager{
-		rooms: make(map[string]*Room),
+		rooms:  make(map[string]*Room),
+		config: cfg,
+	}
+}
+
+// Config returns the configuration the manager hands to every room it creates
+func (m *Manager) Config() *config.Config {
+	return m.config
+}
+
+var (
+	ErrInvalidCapacity = errors.New("invalid room capacity")
+	ErrCodecNotAllowed = errors.New("codec not enabled on this server")
+)
+
+// ResolveCapacity turns a capacity requested at room creation into the one the room will enforce.
+// Zero selects the configured default, larger requests are capped at the configured maximum.
+func (m *Manager) ResolveCapacity(requested int) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, ErrInvalidCapacity
+	case requested == 0:
+		return m.config.Rooms.DefaultCapacity, nil
+	case requested > m.config.Rooms.MaxCapacity:
+		return m.config.Rooms.MaxCapacity, nil
+	}
+	return requested, nil
+}
+
+// ResolveVideoCodecs turns the video codecs requested at room creation, most preferred first, into
+// the ones the room will negotiate. None selects the server's list, each one must be on it.
+func (m *Manager) ResolveVideoCodecs(requested []string) ([]string, error) {
+	allowed := m.config.WebRTC.Codecs.Video
+	if len(requested) == 0 {
+		return slices.Clone(allowed), nil
+	}
+	codecs := make([]string, 0, len(requested))
+	for _, name := range requested {
+		i := slices.IndexFunc(allowed, func(codec string) bool { return strings.EqualFold(codec, name) })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrCodecNotAllowed, name)
+		}
+		if !slices.Contains(codecs, allowed[i]) {
+			codecs = append(codecs, allowed[i])
+		}
 	}
+	return codecs, nil
 }
 
 // CreateRoom creates a new room with the given ID or returns the existing one
@@ -41,6 +99,17 @@ func (m *Manager) CreateRoom(roomID string, capacity int, room *Room) {
 		room.ID = roomID
 		room.Peers = make(map[uuid.UUID]*models.Peer)
 		room.Capacity = capacity
+		room.RTCConfig = m.config.WebRTC.RTCConfiguration()
+		room.Config = m.config
+		room.SinglePresenter = m.config.Rooms.SinglePresenter
+		room.VideoCodecs = slices.Clone(m.config.WebRTC.Codecs.Video)
+		if room.AccessDetails == nil { // Creators may have set a password already
+			room.AccessDetails = &models.AccessDetails{}
+		}
+		if room.ManagementDetails == nil { // Creators may have been recorded already
+			room.ManagementDetails = &models.ManagementDetails{}
+		}
+		room.ManagementDetails.CreatedAt = time.Now()
 		m.rooms[roomID] = room
 	}
 }
@@ -60,6 +129,7 @@ func (m *Manager) DeleteRoom(roomID string) {
 	if room == nil {
 		return
 	}
+	room.denyAllWaiting()
 	room.ListLock.RLock()
 	defer room.ListLock.RUnlock()
 	for _, peer := range room.Peers {
@@ -0,0 +1,93 @@
+package room
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrTargetOutranks = errors.New("you cannot moderate a peer with the same or a higher role")
+
+// moderationTarget looks up the peer a moderator acts on, moderators can only act on lower roles
+func (r *Room) moderationTarget(actor, target uuid.UUID) (*models.Peer, error) {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	p, ok := r.Peers[target]
+	if !ok {
+		return nil, ErrPeerNotInRoom
+	}
+	if r.roleOf(target) >= r.roleOf(actor) {
+		return nil, ErrTargetOutranks
+	}
+	return p, nil
+}
+
+// Kick removes a peer from the room and closes its signaling connection
+func (r *Room) Kick(actor, target uuid.UUID, reason string) error {
+	p, err := r.moderationTarget(actor, target)
+	if err != nil {
+		return err
+	}
+	event := models.ModerationEventPayload{Action: "kick", PeerID: target.String(), By: actor.String(), Reason: reason}
+	SignalPeer(p, models.MessageTypeModeration, event, true) // Before the socket goes away
+	r.RemovePeer(p)
+	p.WebSocket.Close()
+	r.Broadcast(models.MessageTypeModeration, event, nil)
+	logger.LogInfo("Peer kicked", "peerId", target.String(), "by", actor.String(), "roomId", r.ID)
+	return nil
+}
+
+// ForceMute stops (or resumes) forwarding the peer's audio to everyone else
+func (r *Room) ForceMute(actor, target uuid.UUID, muted bool, reason string) error {
+	p, err := r.moderationTarget(actor, target)
+	if err != nil {
+		return err
+	}
+	p.AudioForceMuted.Store(muted)
+	r.PeerUpdated(p)
+	action := "mute"
+	if !muted {
+		action = "unmute"
+	}
+	r.Broadcast(models.MessageTypeModeration, models.ModerationEventPayload{Action: action, PeerID: target.String(), By: actor.String(), Reason: reason}, nil)
+	logger.LogInfo("Peer audio moderated", "peerId", target.String(), "muted", muted, "by", actor.String(), "roomId", r.ID)
+	return nil
+}
+
+// resumeVideo makes the subscribers of the peer's video start over from a fresh keyframe, the
+// screen share's too when withScreen is set
+func resumeVideo(p *models.Peer, withScreen bool) {
+	p.TrackLock.RLock()
+	publications := slices.Collect(maps.Values(p.Publications))
+	p.TrackLock.RUnlock()
+	for _, publication := range publications {
+		if publication.Kind == webrtc.RTPCodecTypeVideo && (withScreen || !publication.Screen) {
+			publication.Resume()
+		}
+	}
+}
+
+// DisableVideo stops (or resumes) forwarding the peer's video to everyone else
+func (r *Room) DisableVideo(actor, target uuid.UUID, disabled bool, reason string) error {
+	p, err := r.moderationTarget(actor, target)
+	if err != nil {
+		return err
+	}
+	if !disabled && p.VideoForceDisabled.Load() {
+		resumeVideo(p, true) // Before forwarding starts again so no subscriber gets a frame it can't decode
+	}
+	p.VideoForceDisabled.Store(disabled)
+	r.PeerUpdated(p)
+	action := "disable-video"
+	if !disabled {
+		action = "enable-video"
+	}
+	r.Broadcast(models.MessageTypeModeration, models.ModerationEventPayload{Action: action, PeerID: target.String(), By: actor.String(), Reason: reason}, nil)
+	logger.LogInfo("Peer video moderated", "peerId", target.String(), "disabled", disabled, "by", actor.String(), "roomId", r.ID)
+	return nil
+}
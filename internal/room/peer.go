@@ -3,16 +3,20 @@ package room
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 	"video_conferencing_server/internal/logger"
 	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+	rtcapi "video_conferencing_server/internal/webrtc"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -48,77 +52,68 @@ func (r *Room) InitializePeer(id string, displayName *string, ws *websocket.Conn
 		return ErrRoomIsNil
 	}
 	if currentPeer == nil {
-		currentPeer = &models.Peer{
-			ID:             uuid.New(),
-			DisplayName:    displayName,
-			PeerConnection: nil,
-			Tracks:         []*webrtc.TrackLocalStaticRTP{},
-			WebSocket:      ws,
-			SocketLock:     sync.Mutex{},
-			Done:           make(chan bool),
-		}
+		currentPeer = &models.Peer{}
 	}
-	if currentPeer != nil && !currentPeer.IsCreated() {
-		currentPeer.ID = uuid.New()
-		currentPeer.DisplayName = displayName
-		currentPeer.PeerConnection = nil
-		currentPeer.Tracks = []*webrtc.TrackLocalStaticRTP{}
-		currentPeer.WebSocket = ws
-		currentPeer.SocketLock = sync.Mutex{}
-		currentPeer.SignalLock = sync.Mutex{}
-		currentPeer.Done = make(chan bool)
+	if !currentPeer.IsCreated() {
+		resetPeer(currentPeer, displayName, ws)
 	}
 
-	if _, exists := r.Peers[currentPeer.ID]; exists {
-		return ErrPeerExists
-	}
-	if len(r.Peers) >= 10 {
-		logger.LogError(ErrRoomFull.Error(), "roomId", r.ID)
-		r.SignalPeer(currentPeer, "room-full", json.RawMessage(`"`+ErrRoomFull.Error()+`"`), false)
-		return ErrRoomFull
-	}
 	err := r.newPeerConnection(currentPeer)
 	if err != nil {
 		return err
 	}
+
+	// The capacity check and the insert happen under the same lock so concurrent joins can't overshoot
 	r.ListLock.Lock()
-	defer r.ListLock.Unlock()
+	if _, exists := r.Peers[currentPeer.ID]; exists {
+		r.ListLock.Unlock()
+		currentPeer.PeerConnection.Close()
+		return ErrPeerExists
+	}
+	if occupancy := len(r.Peers); occupancy >= r.Capacity {
+		r.ListLock.Unlock()
+		logger.LogError(ErrRoomFull.Error(), "roomId", r.ID, "capacity", r.Capacity, "occupancy", occupancy)
+		r.SignalPeer(currentPeer, models.MessageTypeRoomFull, models.RoomFullPayload{
+			Error:     ErrRoomFull.Error(),
+			Capacity:  r.Capacity,
+			Occupancy: occupancy,
+		}, true)
+		currentPeer.PeerConnection.Close() // Signal first, closing the connection also closes the socket
+		return ErrRoomFull
+	}
+	currentPeer.JoinedAt = time.Now()
 	r.Peers[currentPeer.ID] = currentPeer
+	r.claimOwnership(currentPeer)
+	r.ListLock.Unlock()
+	go r.runAllocator(currentPeer)
 	return nil
 }
 
+// resetPeer gives a peer a fresh identity and signaling state, everything but its PeerConnection
+func resetPeer(p *models.Peer, displayName *string, ws *websocket.Conn) {
+	p.ID = uuid.New()
+	p.DisplayName = displayName
+	p.PeerConnection = nil
+	p.WebSocket = ws
+	p.SocketLock = sync.Mutex{}
+	p.SignalLock = sync.Mutex{}
+	p.Done = make(chan bool)
+}
+
 func (r *Room) newPeerConnection(p *models.Peer) error {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	peerConnection, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		return err
-	}
-	streamID := fmt.Sprintf("stream-%s", p.ID.String())
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
-		"video",
-		streamID,
-	)
+	p.Allocator = sfu.NewAllocator()
+	api, err := rtcapi.NewAPI(r.codecConfig(), r.Config.WebRTC.Bandwidth, func(estimator cc.BandwidthEstimator) {
+		r.watchEstimator(p, estimator)
+	})
 	if err != nil {
-		logger.LogError("Error creating local video track", "error", err)
 		return err
 	}
-	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
-		"audio",
-		streamID,
-	)
+	peerConnection, err := api.NewPeerConnection(r.RTCConfig)
 	if err != nil {
-		logger.LogError("Error creating local audio track", "error", err)
 		return err
 	}
-	p.Tracks = append(p.Tracks, videoTrack, audioTrack) // Will add tracks when receiving an offer
+	resetTracks(p) // Forwarding tracks are created as the peer publishes, see OnTrack
+	r.resetDataChannels(p)
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		logger.LogInfo("Peer Connection State changed", "state", state.String(), "peerId", p.ID.String(), "roomId", r.ID)
 		if state == webrtc.PeerConnectionStateClosed ||
@@ -131,94 +126,53 @@ func (r *Room) newPeerConnection(p *models.Peer) error {
 	})
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		// This is the handler func for incoming tracks from the peer (audio and video)
-		logger.LogInfo("Received remote track", "kind", remoteTrack.Kind().String(), "peerId", p.ID.String(), "roomId", r.ID)
+		logger.LogInfo("Received remote track", "kind", remoteTrack.Kind().String(), "codec", remoteTrack.Codec().MimeType,
+			"trackId", remoteTrack.ID(), "rid", remoteTrack.RID(), "peerId", p.ID.String(), "roomId", r.ID)
 
-		// r.ListLock.RLock()
-		for _, otherPeer := range r.Peers {
-			if otherPeer.ID == p.ID {
-				continue // Don't send to self
-			}
-			logger.LogInfo("Forwarding track to peer", "toPeerId", otherPeer.ID.String(), "fromPeerId", p.ID.String())
-			for _, track := range p.Tracks {
-				if track.Kind() != remoteTrack.Kind() {
-					continue
-				}
-				// if track.ID() == remoteTrack.ID() {
-				// 	logger.Logger.Warn("Track already exists for peer, skipping", "peerId", otherPeer.ID.String(), "trackId", track.ID())
-				// 	continue
-				// }
-				_, err = otherPeer.PeerConnection.AddTrack(track)
-				if err != nil {
-					logger.LogError("Error adding track to PeerConnection", "error", err, "toPeerId", otherPeer.ID.String(), "fromPeerId", p.ID.String())
-				}
-			}
-			// logger.LogInfo("Track 1:", p.Tracks[0].ID)
-			// logger.LogInfo("Track 2:", p.Tracks[1].ID)
-
-			// Renegotiate with existing peer
-			// offer, err := otherPeer.PeerConnection.CreateOffer(nil)
-			// if err != nil {
-			// 	logger.LogError("Error creating renegotiation offer", "error", err, "peerId", otherPeer.ID.String())
-			// 	continue
-			// }
-
-			// err = otherPeer.PeerConnection.SetLocalDescription(offer)
-			// if err != nil {
-			// 	logger.LogError("Error setting local renegotiation description", "error", err, "peerId", otherPeer.ID.String())
-			// 	continue
-			// }
-
-			// err = SignalPeer(otherPeer, models.MessageTypeOffer, offer.SDP, true)
-			// if err != nil {
-			// 	logger.LogError("Error signaling peer with renegotiation offer", "error", err, "peerId", otherPeer.ID.String())
-			// 	continue
-			// }
-
-			r.AttemptRenegotiation(otherPeer)
-
-			if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
-				go func() {
-					if err := peerConnection.WriteRTCP([]rtcp.Packet{
-						&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
-					}); err != nil {
-						logger.LogError("Error sending immediate PLI", "error", err)
-					}
-				}()
-			}
+		publication := r.publishTrack(p, remoteTrack)
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			publication.SetDependencyDescriptorID(headerExtensionID(receiver, rtcapi.DependencyDescriptorURI))
 		}
-		// r.ListLock.RUnlock()
-
-		// PLI Ticker
-		go func() {
-			ticker := time.NewTicker(3 * time.Second)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ticker.C:
-					// Send a PLI on the "receiver"
-					rtcpSendErr := peerConnection.WriteRTCP([]rtcp.Packet{
-						&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
-					})
-					if rtcpSendErr != nil {
-						logger.LogError("Error sending RTCP PLI", "error", rtcpSendErr)
+		ended := make(chan struct{}) // Closed by the RTP pump
+
+		// Keyframes are requested as subscribers need them, this is only for clients that ignore those requests
+		if interval := r.Config.WebRTC.Keyframes.FallbackSeconds; interval > 0 && remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			go func() {
+				ticker := time.NewTicker(time.Duration(interval) * time.Second)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ticker.C:
+						publication.RequestKeyframe(remoteTrack.RID())
+					case <-ended:
+						return
 					}
-				case <-p.Done:
-					return
 				}
-			}
-		}()
+			}()
+		}
 
 		// RTP Pump
 		go func() {
-			raddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4002") // Debugging UDP address for VLC (tap)
-			debugConn, err := net.DialUDP("udp", nil, raddr)
-			if err != nil {
-				fmt.Println("Debug UDP Error:", err)
+			defer r.unpublishLayer(p, remoteTrack) // The remote track ended, or the peer left
+			defer close(ended)
+
+			var debugConn *net.UDPConn
+			if r.Config.WebRTC.RTPTapAddr != "" {
+				raddr, _ := net.ResolveUDPAddr("udp", r.Config.WebRTC.RTPTapAddr) // Debugging UDP address for VLC (tap)
+				var dialErr error
+				debugConn, dialErr = net.DialUDP("udp", nil, raddr)
+				if dialErr != nil {
+					logger.LogError("Error dialing RTP tap", "error", dialErr, "addr", r.Config.WebRTC.RTPTapAddr)
+				} else {
+					defer debugConn.Close()
+				}
 			}
-			defer debugConn.Close()
 
+			screen := isScreenTrack(p, remoteTrack.ID()) // Camera and mic state don't apply to the screen share
+			audioLevelID := headerExtensionID(receiver, sdp.AudioLevelURI)
 			buf := make([]byte, 1500)
+			packet := &rtp.Packet{}
 			for {
 				select {
 				case <-p.Done:
@@ -226,27 +180,49 @@ func (r *Room) newPeerConnection(p *models.Peer) error {
 				default:
 					n, _, readErr := remoteTrack.Read(buf)
 					if readErr != nil {
-						logger.LogError("Error reading from remote track", "error", readErr)
+						if errors.Is(readErr, io.EOF) {
+							logger.LogInfo("Remote track ended", "trackId", remoteTrack.ID(), "peerId", p.ID.String())
+						} else {
+							logger.LogError("Error reading from remote track", "error", readErr)
+						}
 						return
 					}
 
 					if debugConn != nil {
 						debugConn.Write(buf[:n])
 					}
+					if err := packet.Unmarshal(buf[:n]); err != nil {
+						logger.LogError("Error parsing RTP packet", "error", err, "peerId", p.ID.String())
+						continue
+					}
 
 					if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
-						if _, err := p.Tracks[0].Write(buf[:n]); err != nil {
-							logger.LogError("Error writing to local video track", "error", err)
+						if p.VideoForceDisabled.Load() {
+							continue // Stopped by a moderator
+						}
+						if p.VideoOff.Load() && r.Config.WebRTC.DropMutedMedia && !screen {
+							continue // Only black frames, not worth the bandwidth
 						}
 					} else if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
-						if _, err := p.Tracks[1].Write(buf[:n]); err != nil {
-							logger.LogError("Error writing to local audio track", "error", err)
+						if audioLevelID != 0 && !screen {
+							recordAudioLevel(p, packet, audioLevelID)
+						}
+						if p.AudioForceMuted.Load() {
+							continue // Muted by a moderator
+						}
+						if p.AudioMuted.Load() && r.Config.WebRTC.DropMutedMedia && !screen {
+							continue // Only silence, not worth the bandwidth
 						}
 					}
+					publication.Forward(remoteTrack.RID(), packet)
 				}
 			}
 		}()
 	})
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		logger.LogInfo("Received data channel", "label", dc.Label(), "peerId", p.ID.String(), "roomId", r.ID)
+		r.acceptDataChannel(p, dc)
+	})
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil {
 			return
@@ -316,6 +292,8 @@ func (r *Room) HandleOffer(p *models.Peer, offerData json.RawMessage) error {
 		logger.LogError("Error setting remote description", "error", err)
 		return err
 	}
+	recordCodecs(p, offer)
+	r.dropUndecodable(p) // Subscribed before the peer said what it can decode
 	answer, err := p.PeerConnection.CreateAnswer(nil)
 	if err != nil {
 		logger.LogError("Error creating answer", "error", err)
@@ -396,23 +374,18 @@ func (r *Room) HandleIceCandidate(p *models.Peer, candidateData json.RawMessage)
 	return nil
 }
 
+// AddTracksToPeer subscribes a new peer to everything the others already publish
 func (r *Room) AddTracksToPeer(p *models.Peer) {
-	r.ListLock.RLock()
-	defer r.ListLock.RUnlock()
-
-	for _, otherPeer := range r.Peers {
-		if otherPeer.ID == p.ID {
-			continue // Skip self
+	for _, otherPeer := range r.otherPeers(p) {
+		otherPeer.TrackLock.RLock()
+		publications := make([]*sfu.Publication, 0, len(otherPeer.Publications))
+		for _, publication := range otherPeer.Publications {
+			publications = append(publications, publication)
 		}
-		if len(otherPeer.Tracks) == 0 {
-			continue // No tracks to add
-		}
-		// logger.LogInfo("Adding existing tracks from peer to new peer", "fromPeerId", otherPeer.ID.String(), "toPeerId", p.ID.String())
-		for _, track := range otherPeer.Tracks {
-			_, err := p.PeerConnection.AddTrack(track)
-			if err != nil {
-				logger.LogError("Error adding track to PeerConnection", "error", err, "peerId", p.ID.String())
-			}
+		otherPeer.TrackLock.RUnlock()
+
+		for _, publication := range publications {
+			r.subscribe(p, otherPeer, publication)
 		}
 	}
 }
@@ -474,25 +447,49 @@ func (r *Room) IsCreated() bool {
 	return r.ID != ""
 }
 
-// RemovePeer removes a peer from the room and cleans up resources
+// RemovePeer removes a peer from the room or its waiting list and cleans up resources. Its tracks
+// are removed from the other peers' sessions right away rather than left for their browsers to find
+// silent. A peer that is neither in the room nor waiting is ignored, departures usually remove a
+// peer twice (the closed PeerConnection and the closed socket).
 func (r *Room) RemovePeer(p *models.Peer) {
+	peer, waiting := r.removePeer(p)
+	if peer != nil {
+		r.unpublishAll(peer)
+	}
+	if waiting != nil {
+		r.signalModerators(models.MessageTypeWaitingPeerRemoved, models.PeerTargetPayload{PeerID: waiting.ID.String()})
+		logger.LogInfo("Waiting peer removed from room", "peerId", waiting.ID.String(), "roomId", r.ID)
+	}
+}
+
+// removePeer takes the peer out of the room and returns it, or out of the waiting list and returns
+// it as waiting. Both are nil if it was in neither.
+func (r *Room) removePeer(p *models.Peer) (peer, waiting *models.Peer) {
 	r.ListLock.Lock()
 	defer r.ListLock.Unlock()
 
 	peer, exists := r.Peers[p.ID]
 	if !exists {
-		logger.LogError("Attempted to remove non-existent peer", "peerId", p.ID.String())
-		return
+		return nil, r.removeWaitingPeerLocked(p.ID)
 	}
 	close(peer.Done)
+	r.dropSubscriptions(peer)
 	if peer.PeerConnection != nil {
 		peer.PeerConnection.Close()
 	}
 	delete(r.Peers, p.ID)
-	for _, px := range r.Peers {
-		SignalPeer(px, "peer-left", p.ID.String(), true)
+	r.RosterVersion++
+	r.fanOut(models.MessageTypePeerLeft, models.PeerLeftPayload{Version: r.RosterVersion, PeerID: p.ID.String()}, uuid.Nil)
+	r.releasePresenter(p.ID)
+	newOwner := r.releaseRoles(p.ID)
+	if newOwner != nil {
+		r.broadcastRolesLocked()
+		for _, waiting := range r.WaitingList { // The new owner is in charge of admitting them now
+			SignalPeer(newOwner, models.MessageTypeWaitingPeer, models.WaitingPeerPayload{PeerID: waiting.ID.String(), DisplayName: waiting.DisplayName}, true)
+		}
 	}
 	logger.LogInfo("Peer removed from room", "peerId", p.ID.String(), "roomId", r.ID)
+	return peer, nil
 }
 
 // Broadcast sends a message to all peers in the room, optionally excluding one peer
@@ -0,0 +1,58 @@
+package room
+
+import (
+	"testing"
+	"time"
+	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+func newTestPeer() *models.Peer {
+	return &models.Peer{
+		ID:           uuid.New(),
+		Publications: make(map[string]*sfu.Publication),
+		Senders:      make(map[string]*webrtc.RTPSender),
+		Done:         make(chan bool),
+	}
+}
+
+// removeTwice fails the test instead of hanging when RemovePeer deadlocks
+func removeTwice(t *testing.T, r *Room, p *models.Peer) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		r.RemovePeer(p)
+		r.RemovePeer(p)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RemovePeer deadlocked")
+	}
+}
+
+func TestRemovePeerTwice(t *testing.T) {
+	r := &Room{ID: "room", Peers: make(map[uuid.UUID]*models.Peer)}
+	p := newTestPeer()
+	r.Peers[p.ID] = p
+
+	removeTwice(t, r, p)
+	if len(r.Peers) != 0 {
+		t.Fatalf("peer still in the room: %v", r.Peers)
+	}
+}
+
+func TestRemoveWaitingPeerTwice(t *testing.T) {
+	r := &Room{ID: "room", Peers: make(map[uuid.UUID]*models.Peer)}
+	p := newTestPeer()
+	r.WaitingList = []*models.Peer{p}
+
+	removeTwice(t, r, p)
+	if len(r.WaitingList) != 0 {
+		t.Fatalf("peer still waiting: %v", r.WaitingList)
+	}
+}
@@ -0,0 +1,70 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"video_conferencing_server/internal/models"
+)
+
+const (
+	MaxDisplayNameLength   = 64
+	MaxMetadataEntries     = 8
+	MaxMetadataKeyLength   = 32
+	MaxMetadataValueLength = 256
+)
+
+var (
+	ErrInvalidDisplayName = errors.New("display name must be 1-64 printable characters")
+	ErrInvalidMetadata    = errors.New("invalid peer metadata")
+)
+
+// StreamID is the MediaStream id the peer's forwarded tracks carry, clients use it to map tracks to peers
+func StreamID(p *models.Peer) string {
+	return fmt.Sprintf("stream-%s", p.ID.String())
+}
+
+// ScreenStreamID is the MediaStream id of the peer's screen share, kept apart from its camera stream
+func ScreenStreamID(p *models.Peer) string {
+	return fmt.Sprintf("screen-%s", p.ID.String())
+}
+
+// NormalizeDisplayName trims the name and checks its length and characters
+func NormalizeDisplayName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxDisplayNameLength || !printable(name) {
+		return "", ErrInvalidDisplayName
+	}
+	return name, nil
+}
+
+// ValidateMetadata checks the small key/value map peers can attach to themselves (avatar URL, role label, ...)
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return fmt.Errorf("%w: at most %d entries", ErrInvalidMetadata, MaxMetadataEntries)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > MaxMetadataKeyLength || strings.IndexFunc(key, func(c rune) bool {
+			return !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '-'))
+		}) >= 0 {
+			return fmt.Errorf("%w: bad key %q", ErrInvalidMetadata, key)
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength || !printable(value) {
+			return fmt.Errorf("%w: bad value for %q", ErrInvalidMetadata, key)
+		}
+	}
+	if avatar, ok := metadata["avatarUrl"]; ok {
+		u, err := url.Parse(avatar)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%w: avatarUrl must be an http(s) URL", ErrInvalidMetadata)
+		}
+	}
+	return nil
+}
+
+func printable(s string) bool {
+	return utf8.ValidString(s) && strings.IndexFunc(s, func(c rune) bool { return !unicode.IsPrint(c) }) < 0
+}
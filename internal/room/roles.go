@@ -0,0 +1,212 @@
+package room
+
+import (
+	"errors"
+	"slices"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Role is what a peer may do in a room, higher roles include the lower ones
+type Role int
+
+const (
+	RoleParticipant Role = iota
+	RoleAdmin
+	RoleOwner
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleOwner:
+		return "owner"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "participant"
+}
+
+var (
+	ErrNotModerator  = errors.New("only room owners and admins can do this")
+	ErrNotOwner      = errors.New("only the room owner can do this")
+	ErrPeerNotInRoom = errors.New("peer is not in the room")
+	ErrTargetIsOwner = errors.New("the room owner cannot be targeted")
+)
+
+// SetCreator records the authenticated user creating the room, it gets ownership back whenever it rejoins
+func (r *Room) SetCreator(userID uuid.UUID) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if r.ManagementDetails == nil {
+		r.ManagementDetails = &models.ManagementDetails{}
+	}
+	r.ManagementDetails.Creator = userID
+}
+
+// RoleOf returns the role of the peer with the given ID
+func (r *Room) RoleOf(id uuid.UUID) Role {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return r.roleOf(id)
+}
+
+// roleOf expects the caller to hold ListLock
+func (r *Room) roleOf(id uuid.UUID) Role {
+	if r.ManagementDetails == nil || id == uuid.Nil {
+		return RoleParticipant
+	}
+	if r.ManagementDetails.Owner == id {
+		return RoleOwner
+	}
+	if slices.Contains(r.ManagementDetails.Admin, id) {
+		return RoleAdmin
+	}
+	return RoleParticipant
+}
+
+// IsModerator reports whether the peer owns or administers the room
+func (r *Room) IsModerator(p *models.Peer) bool {
+	return r.RoleOf(p.ID) >= RoleAdmin
+}
+
+// isModerator expects the caller to hold ListLock
+func (r *Room) isModerator(id uuid.UUID) bool {
+	return r.roleOf(id) >= RoleAdmin
+}
+
+// claimOwnership decides the role of a peer entering the room, the caller holds ListLock.
+// The first peer owns the room, unless an authenticated creator was recorded or the peer's
+// join token grants ownership, then they always do. Tokens can also grant the admin role.
+func (r *Room) claimOwnership(p *models.Peer) {
+	md := r.ManagementDetails
+	if md == nil {
+		return
+	}
+	if p.GrantedRole == RoleAdmin.String() && md.Owner != uuid.Nil {
+		md.Admin = appendUnique(md.Admin, p.ID)
+		return
+	}
+	if md.Owner == uuid.Nil || (md.Creator != uuid.Nil && md.Creator == p.UserID) || p.GrantedRole == RoleOwner.String() {
+		if md.Owner != uuid.Nil && md.Owner != p.ID {
+			md.Admin = appendUnique(md.Admin, md.Owner) // The stand-in owner keeps moderating
+		}
+		md.Owner = p.ID
+		md.Admin = slices.DeleteFunc(md.Admin, func(id uuid.UUID) bool { return id == p.ID })
+	}
+}
+
+// releaseRoles drops the roles of a peer leaving the room and hands ownership over when needed,
+// the caller holds ListLock and has already removed the peer from r.Peers. Admins are preferred
+// as successors, then whoever has been in the room the longest.
+func (r *Room) releaseRoles(id uuid.UUID) (newOwner *models.Peer) {
+	md := r.ManagementDetails
+	if md == nil {
+		return nil
+	}
+	md.Admin = slices.DeleteFunc(md.Admin, func(admin uuid.UUID) bool { return admin == id })
+	if md.Owner != id {
+		return nil
+	}
+	md.Owner = uuid.Nil
+	for _, admin := range md.Admin {
+		if p, ok := r.Peers[admin]; ok && (newOwner == nil || p.JoinedAt.Before(newOwner.JoinedAt)) {
+			newOwner = p
+		}
+	}
+	if newOwner == nil {
+		for _, p := range r.Peers {
+			if newOwner == nil || p.JoinedAt.Before(newOwner.JoinedAt) {
+				newOwner = p
+			}
+		}
+	}
+	if newOwner != nil {
+		md.Owner = newOwner.ID
+		md.Admin = slices.DeleteFunc(md.Admin, func(admin uuid.UUID) bool { return admin == newOwner.ID })
+		logger.LogInfo("Room ownership transferred", "roomId", r.ID, "from", id.String(), "to", newOwner.ID.String())
+	}
+	return newOwner
+}
+
+// SetAdmin promotes a peer to admin or demotes it back to participant
+func (r *Room) SetAdmin(peerID uuid.UUID, admin bool) error {
+	r.ListLock.Lock()
+	if _, ok := r.Peers[peerID]; !ok {
+		r.ListLock.Unlock()
+		return ErrPeerNotInRoom
+	}
+	if r.ManagementDetails.Owner == peerID {
+		r.ListLock.Unlock()
+		return ErrTargetIsOwner
+	}
+	if admin {
+		r.ManagementDetails.Admin = appendUnique(r.ManagementDetails.Admin, peerID)
+	} else {
+		r.ManagementDetails.Admin = slices.DeleteFunc(r.ManagementDetails.Admin, func(id uuid.UUID) bool { return id == peerID })
+	}
+	r.ListLock.Unlock()
+
+	logger.LogInfo("Admin role changed", "roomId", r.ID, "peerId", peerID.String(), "admin", admin)
+	r.BroadcastRoles()
+	return nil
+}
+
+// TransferOwnership makes another peer the owner, the previous owner stays on as admin
+func (r *Room) TransferOwnership(peerID uuid.UUID) error {
+	r.ListLock.Lock()
+	if _, ok := r.Peers[peerID]; !ok {
+		r.ListLock.Unlock()
+		return ErrPeerNotInRoom
+	}
+	md := r.ManagementDetails
+	if md.Owner != peerID {
+		if md.Owner != uuid.Nil {
+			md.Admin = appendUnique(md.Admin, md.Owner)
+		}
+		md.Owner = peerID
+		md.Admin = slices.DeleteFunc(md.Admin, func(id uuid.UUID) bool { return id == peerID })
+	}
+	r.ListLock.Unlock()
+
+	logger.LogInfo("Room ownership transferred", "roomId", r.ID, "to", peerID.String())
+	r.BroadcastRoles()
+	return nil
+}
+
+// Roles returns the current owner and admins of the room
+func (r *Room) Roles() models.RolesPayload {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return r.roles()
+}
+
+// roles expects the caller to hold ListLock
+func (r *Room) roles() models.RolesPayload {
+	roles := models.RolesPayload{Version: r.RosterVersion, Admins: []string{}}
+	if r.ManagementDetails == nil {
+		return roles
+	}
+	if r.ManagementDetails.Owner != uuid.Nil {
+		roles.Owner = r.ManagementDetails.Owner.String()
+	}
+	for _, admin := range r.ManagementDetails.Admin {
+		roles.Admins = append(roles.Admins, admin.String())
+	}
+	return roles
+}
+
+// BroadcastRoles tells every participant who owns and administers the room
+func (r *Room) BroadcastRoles() {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	r.broadcastRolesLocked()
+}
+
+func appendUnique(ids []uuid.UUID, id uuid.UUID) []uuid.UUID {
+	if slices.Contains(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
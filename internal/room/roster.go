@@ -0,0 +1,102 @@
+package room
+
+import (
+	"slices"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// peerInfo describes a peer to the other participants, the caller holds ListLock
+func (r *Room) peerInfo(p *models.Peer) models.PeerInfo {
+	info := models.PeerInfo{
+		PeerID:        p.ID.String(),
+		DisplayName:   p.DisplayName,
+		Metadata:      p.Metadata,
+		StreamID:      StreamID(p),
+		Role:          r.roleOf(p.ID).String(),
+		JoinedAt:      p.JoinedAt,
+		AudioMuted:    p.AudioMuted.Load() || p.AudioForceMuted.Load(),
+		VideoOff:      p.VideoOff.Load() || p.VideoForceDisabled.Load(),
+		ScreenSharing: p.ScreenSharing.Load(),
+
+		AudioForceMuted:    p.AudioForceMuted.Load(),
+		VideoForceDisabled: p.VideoForceDisabled.Load(),
+	}
+	if info.ScreenSharing {
+		info.ScreenStreamID = ScreenStreamID(p)
+	}
+	return info
+}
+
+// SetMediaState records what the client reports about its media and tells the room
+func (r *Room) SetMediaState(p *models.Peer, state models.MediaStatePayload) {
+	if !state.VideoOff && p.VideoOff.Load() && r.Config.WebRTC.DropMutedMedia {
+		resumeVideo(p, false) // The camera's packets were dropped, its next frames reference ones nobody got
+	}
+	p.AudioMuted.Store(state.AudioMuted)
+	p.VideoOff.Store(state.VideoOff)
+	r.PeerUpdated(p)
+}
+
+// roster builds the full roster ordered by join time, the caller holds ListLock
+func (r *Room) roster() models.RosterPayload {
+	peers := make([]models.PeerInfo, 0, len(r.Peers))
+	for _, p := range r.Peers {
+		peers = append(peers, r.peerInfo(p))
+	}
+	slices.SortFunc(peers, func(a, b models.PeerInfo) int { return a.JoinedAt.Compare(b.JoinedAt) })
+	return models.RosterPayload{Version: r.RosterVersion, Peers: peers, Presenter: r.presenter().PeerID}
+}
+
+// Roster returns a snapshot of everyone in the room
+func (r *Room) Roster() models.RosterPayload {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return r.roster()
+}
+
+// fanOut sends a message to every peer but the excluded one, the caller holds ListLock
+func (r *Room) fanOut(event models.WebsocketMessageEvent, data interface{}, exclude uuid.UUID) {
+	for _, p := range r.Peers {
+		if p.ID != exclude {
+			SignalPeer(p, event, data, true)
+		}
+	}
+}
+
+// AnnouncePeer sends the full roster to a peer that just entered the room and tells everyone else
+// about it. Both happen under the room lock so the newcomer's snapshot and the versions the others
+// see line up.
+func (r *Room) AnnouncePeer(p *models.Peer) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	r.RosterVersion++
+	SignalPeer(p, models.MessageTypeRoster, r.roster(), true)
+	r.fanOut(models.MessageTypePeerJoined, models.RosterUpdatePayload{Version: r.RosterVersion, Peer: r.peerInfo(p)}, p.ID)
+}
+
+// PeerUpdated tells everyone that something about the peer (name, role, media state, ...) changed
+func (r *Room) PeerUpdated(p *models.Peer) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	if _, ok := r.Peers[p.ID]; !ok {
+		return
+	}
+	r.RosterVersion++
+	r.fanOut(models.MessageTypePeerUpdated, models.RosterUpdatePayload{Version: r.RosterVersion, Peer: r.peerInfo(p)}, uuid.Nil)
+}
+
+// broadcastRolesLocked bumps the roster version and sends the roles to everyone, the caller holds ListLock
+func (r *Room) broadcastRolesLocked() {
+	r.RosterVersion++
+	r.fanOut(models.MessageTypeRolesChanged, r.roles(), uuid.Nil)
+}
+
+// HasPeer reports whether the peer is in the room (waiting peers are not)
+func (r *Room) HasPeer(p *models.Peer) bool {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	_, ok := r.Peers[p.ID]
+	return ok
+}
@@ -0,0 +1,92 @@
+package room
+
+import (
+	"time"
+	"video_conferencing_server/internal/metrics"
+	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// readRTCP drains the feedback a subscriber sends about one of its tracks: keyframe requests go to
+// the publisher, NACKs are answered from the down track's packet cache and reception reports become
+// the subscriber's stats. The interceptors (congestion control, reports) only see the packets
+// that are read.
+func (r *Room) readRTCP(subscriber *models.Peer, sender *webrtc.RTPSender, downTrack *sfu.DownTrack) {
+	var ssrc uint32
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = uint32(encodings[0].SSRC)
+	}
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return // The track was removed or the connection closed
+		}
+		now := time.Now()
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				downTrack.RequestKeyframe()
+			case *rtcp.TransportLayerNack:
+				var seqs []uint16
+				for _, pair := range packet.Nacks {
+					seqs = append(seqs, pair.PacketList()...)
+				}
+				sent, missed := downTrack.Retransmit(seqs)
+				metrics.NacksReceived.Add(int64(len(seqs)))
+				metrics.PacketsRetransmitted.Add(int64(sent))
+				metrics.RetransmitMisses.Add(int64(missed))
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				subscriber.Allocator.SetREMB(int(packet.Bitrate))
+			case *rtcp.ReceiverReport:
+				recordReports(downTrack, ssrc, packet.Reports, now)
+			case *rtcp.SenderReport: // Subscribers that also publish put their reports in there
+				recordReports(downTrack, ssrc, packet.Reports, now)
+			}
+		}
+	}
+}
+
+// recordReports keeps the reception report about the down track, compound packets carry the
+// reports about every track the subscriber receives
+func recordReports(downTrack *sfu.DownTrack, ssrc uint32, reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		if report.SSRC == ssrc {
+			downTrack.UpdateStats(report, now)
+		}
+	}
+}
+
+// ReceiveStats lists what the subscriber reported about each track it receives
+func (r *Room) ReceiveStats(subscriber *models.Peer) models.StatsPayload {
+	stats := models.StatsPayload{Tracks: []models.TrackStats{}}
+	for _, publisher := range r.otherPeers(subscriber) {
+		publisher.TrackLock.RLock()
+		for _, publication := range publisher.Publications {
+			downTrack := publication.DownTrack(subscriber.ID.String())
+			if downTrack == nil {
+				continue
+			}
+			report := downTrack.Stats()
+			layer, _ := downTrack.Layer()
+			track := models.TrackStats{
+				PeerID:       publisher.ID.String(),
+				TrackID:      publication.TrackID,
+				Kind:         publication.Kind.String(),
+				Layer:        layer,
+				FractionLost: report.FractionLost,
+				PacketsLost:  report.PacketsLost,
+				JitterMs:     report.Jitter.Seconds() * 1000,
+				RTTMs:        report.RTT.Seconds() * 1000,
+			}
+			if !report.UpdatedAt.IsZero() {
+				track.UpdatedAt = &report.UpdatedAt
+			}
+			stats.Tracks = append(stats.Tracks, track)
+		}
+		publisher.TrackLock.RUnlock()
+	}
+	return stats
+}
@@ -0,0 +1,122 @@
+package room
+
+import (
+	"errors"
+	"slices"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const MaxScreenTracks = 2 // Video plus the optional tab/system audio
+
+var (
+	ErrPresenterActive   = errors.New("someone else is already presenting")
+	ErrInvalidShareTrack = errors.New("share-start needs one or two track ids")
+	ErrNotSharing        = errors.New("not sharing the screen")
+	ErrAlreadySharing    = errors.New("already sharing the screen, stop the current share first")
+)
+
+// SetSinglePresenter changes the room's screen share policy, it only affects shares started later
+func (r *Room) SetSinglePresenter(single bool) {
+	r.ListLock.Lock()
+	defer r.ListLock.Unlock()
+	r.SinglePresenter = single
+}
+
+// isScreenTrack reports whether the remote track id belongs to the peer's screen share
+func isScreenTrack(p *models.Peer, trackID string) bool {
+	p.TrackLock.RLock()
+	defer p.TrackLock.RUnlock()
+	return slices.Contains(p.ScreenTrackIDs, trackID)
+}
+
+// StartShare records the tracks the peer is about to publish as its screen share and makes it
+// the presenter. With the single presenter policy a second share is refused until the first stops.
+// A peer shares one screen at a time, so its own second share is refused as well.
+func (r *Room) StartShare(p *models.Peer, trackIDs []string) error {
+	if len(trackIDs) == 0 || len(trackIDs) > MaxScreenTracks {
+		return ErrInvalidShareTrack
+	}
+	for _, id := range trackIDs {
+		if id == "" {
+			return ErrInvalidShareTrack
+		}
+	}
+
+	r.ListLock.Lock()
+	if _, ok := r.Peers[p.ID]; !ok {
+		r.ListLock.Unlock()
+		return ErrPeerNotInRoom
+	}
+	if p.ScreenSharing.Load() {
+		r.ListLock.Unlock()
+		return ErrAlreadySharing
+	}
+	if r.SinglePresenter && r.Presenter != uuid.Nil && r.Presenter != p.ID {
+		r.ListLock.Unlock()
+		return ErrPresenterActive
+	}
+	p.TrackLock.Lock()
+	p.ScreenTrackIDs = slices.Clone(trackIDs)
+	p.TrackLock.Unlock()
+	p.ScreenSharing.Store(true)
+	if r.Presenter != p.ID {
+		r.Presenter = p.ID
+		r.fanOut(models.MessageTypePresenterChanged, r.presenter(), uuid.Nil)
+	}
+	r.ListLock.Unlock()
+
+	logger.LogInfo("Screen share started", "peerId", p.ID.String(), "roomId", r.ID)
+	r.PeerUpdated(p)
+	return nil
+}
+
+// StopShare ends the peer's screen share, its forwarding tracks are dropped right away rather than
+// when the client's renegotiation ends them
+func (r *Room) StopShare(p *models.Peer) error {
+	if !p.ScreenSharing.Swap(false) {
+		return ErrNotSharing
+	}
+	p.TrackLock.Lock()
+	trackIDs := p.ScreenTrackIDs
+	p.ScreenTrackIDs = nil
+	p.TrackLock.Unlock()
+	r.unpublishTracks(p, trackIDs...)
+
+	r.ListLock.Lock()
+	r.releasePresenter(p.ID)
+	r.ListLock.Unlock()
+
+	logger.LogInfo("Screen share stopped", "peerId", p.ID.String(), "roomId", r.ID)
+	r.PeerUpdated(p)
+	return nil
+}
+
+// releasePresenter hands the presenter role to the earliest joined peer still sharing when id held it,
+// the caller holds ListLock
+func (r *Room) releasePresenter(id uuid.UUID) {
+	if r.Presenter != id {
+		return
+	}
+	r.Presenter = uuid.Nil
+	for _, peer := range r.Peers {
+		if peer.ID == id || !peer.ScreenSharing.Load() {
+			continue
+		}
+		if r.Presenter == uuid.Nil || peer.JoinedAt.Before(r.Peers[r.Presenter].JoinedAt) {
+			r.Presenter = peer.ID
+		}
+	}
+	r.fanOut(models.MessageTypePresenterChanged, r.presenter(), uuid.Nil)
+}
+
+// presenter describes the current presenter, the caller holds ListLock
+func (r *Room) presenter() models.PresenterPayload {
+	p, ok := r.Peers[r.Presenter]
+	if !ok {
+		return models.PresenterPayload{}
+	}
+	return models.PresenterPayload{PeerID: p.ID.String(), StreamID: ScreenStreamID(p)}
+}
@@ -0,0 +1,25 @@
+package room
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestStartShareTwice(t *testing.T) {
+	r := &Room{ID: "room", Peers: make(map[uuid.UUID]*models.Peer)}
+	p := newTestPeer()
+	r.Peers[p.ID] = p
+	p.ScreenSharing.Store(true) // Already sharing, so the room and the peer aren't signaled
+	p.ScreenTrackIDs = []string{"screen"}
+
+	if err := r.StartShare(p, []string{"other"}); !errors.Is(err, ErrAlreadySharing) {
+		t.Fatalf("err = %v, want %v", err, ErrAlreadySharing)
+	}
+	if !slices.Equal(p.ScreenTrackIDs, []string{"screen"}) {
+		t.Fatalf("screen tracks replaced by %v", p.ScreenTrackIDs)
+	}
+}
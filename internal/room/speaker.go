@@ -0,0 +1,59 @@
+package room
+
+import (
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Peer.AudioLevel holds 127 minus the audio level (-dBov) publishers put in the RTP header
+// extension, so louder is higher, smoothed and scaled by 16 so a cough doesn't steal the spotlight
+const (
+	audioLevelScale     = 16
+	audioLevelSmoothing = 16       // Each packet moves the average 1/16th of the way
+	speakerThreshold    = 127 - 50 // Anything quieter than -50 dBov counts as silence
+)
+
+// headerExtensionID finds the id the publisher negotiated for a header extension, 0 if none
+func headerExtensionID(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == uri {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// recordAudioLevel folds the level carried by an audio packet into the peer's average
+func recordAudioLevel(p *models.Peer, packet *rtp.Packet, extensionID uint8) {
+	payload := packet.GetExtension(extensionID)
+	if payload == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(payload); err != nil {
+		return
+	}
+	loudness := int32(127-level.Level) * audioLevelScale
+	average := p.AudioLevel.Load()
+	p.AudioLevel.Store(average + (loudness-average)/audioLevelSmoothing)
+}
+
+// activeSpeaker is the loudest peer above the silence threshold, uuid.Nil when nobody talks
+func (r *Room) activeSpeaker() uuid.UUID {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+
+	speaker, loudest := uuid.Nil, int32(speakerThreshold*audioLevelScale)
+	for _, p := range r.Peers {
+		if p.AudioMuted.Load() || p.AudioForceMuted.Load() {
+			continue
+		}
+		if level := p.AudioLevel.Load(); level > loudest {
+			speaker, loudest = p.ID, level
+		}
+	}
+	return speaker
+}
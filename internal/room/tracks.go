@@ -0,0 +1,235 @@
+package room
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"time"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+	"video_conferencing_server/internal/sfu"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrTrackNotFound = errors.New("no such track")
+
+// senderKey identifies what a subscriber receives from one publication
+func senderKey(publisher *models.Peer, trackID string) string {
+	return publisher.ID.String() + "/" + trackID
+}
+
+// resetTracks empties the peer's publications and the senders of what it receives
+func resetTracks(p *models.Peer) {
+	p.TrackLock.Lock()
+	p.Publications = make(map[string]*sfu.Publication)
+	p.Senders = make(map[string]*webrtc.RTPSender)
+	p.TrackLock.Unlock()
+}
+
+// publishTrack records a remote track as a publication, with the codec the publisher actually
+// negotiated, and subscribes every other peer in the room. Further simulcast layers of the same
+// track join the existing publication, as does a restarted layer so subscribers keep their track.
+func (r *Room) publishTrack(p *models.Peer, remote *webrtc.TrackRemote) *sfu.Publication {
+	p.TrackLock.Lock()
+	if publication, ok := p.Publications[remote.ID()]; ok {
+		p.TrackLock.Unlock()
+		if publication.Codec.MimeType == remote.Codec().MimeType {
+			publication.AddLayer(remote)
+			return publication
+		}
+		// Renegotiated to another codec, subscribers need a new track of the new codec
+		r.unpublishTracks(p, remote.ID())
+		p.TrackLock.Lock()
+	}
+	trackID, streamID := remote.ID(), StreamID(p)
+	screen := slices.Contains(p.ScreenTrackIDs, remote.ID())
+	if screen {
+		trackID, streamID = "screen-"+remote.ID(), ScreenStreamID(p)
+	}
+	keyframeInterval := time.Duration(r.Config.WebRTC.Keyframes.MinIntervalMillis) * time.Millisecond
+	publication := sfu.NewPublication(p.ID.String(), trackID, streamID, screen, remote, keyframeInterval, p.PeerConnection.WriteRTCP)
+	p.Publications[remote.ID()] = publication
+	p.TrackLock.Unlock()
+
+	for _, subscriber := range r.otherPeers(p) {
+		logger.LogInfo("Forwarding track to peer", "toPeerId", subscriber.ID.String(), "fromPeerId", p.ID.String(), "trackId", trackID)
+		if r.subscribe(subscriber, p, publication) {
+			r.AttemptRenegotiation(subscriber)
+		}
+	}
+	return publication
+}
+
+// unpublishLayer drops a layer whose remote track ended, and the whole publication with its last layer
+func (r *Room) unpublishLayer(p *models.Peer, remote *webrtc.TrackRemote) {
+	p.TrackLock.RLock()
+	publication, ok := p.Publications[remote.ID()]
+	p.TrackLock.RUnlock()
+	if ok && publication.RemoveLayer(remote) {
+		r.unpublishTracks(p, remote.ID())
+	}
+}
+
+// unpublishTracks drops publications and removes them from every subscriber, each subscriber
+// whose session changed renegotiates once
+func (r *Room) unpublishTracks(p *models.Peer, ids ...string) {
+	var publications []*sfu.Publication
+	p.TrackLock.Lock()
+	for _, id := range ids {
+		if publication, ok := p.Publications[id]; ok {
+			publications = append(publications, publication)
+			delete(p.Publications, id)
+		}
+	}
+	p.TrackLock.Unlock()
+	if len(publications) == 0 {
+		return
+	}
+
+	for _, subscriber := range r.otherPeers(p) {
+		changed := false
+		for _, publication := range publications {
+			if r.unsubscribe(subscriber, p, publication) {
+				changed = true
+			}
+		}
+		if changed {
+			r.AttemptRenegotiation(subscriber)
+		}
+	}
+	for _, publication := range publications {
+		logger.LogInfo("Stopped forwarding track", "peerId", p.ID.String(), "trackId", publication.TrackID, "roomId", r.ID)
+	}
+}
+
+// unpublishAll removes everything a peer publishes from the other peers' sessions
+func (r *Room) unpublishAll(p *models.Peer) {
+	p.TrackLock.RLock()
+	ids := slices.Collect(maps.Keys(p.Publications))
+	p.TrackLock.RUnlock()
+	r.unpublishTracks(p, ids...)
+}
+
+// subscribe gives the subscriber its own down track of a publication, it reports whether the
+// subscriber's session changed and needs a renegotiation. AddTrack reuses a transceiver freed by
+// an earlier unsubscribe once that was negotiated, so departed peers don't leave dead m-lines.
+func (r *Room) subscribe(subscriber, publisher *models.Peer, publication *sfu.Publication) bool {
+	subscriber.TrackLock.RLock()
+	decodable := canReceive(subscriber, publication)
+	subscriber.TrackLock.RUnlock()
+	if !decodable {
+		r.signalUnsupported(subscriber, publisher, publication)
+		return false
+	}
+
+	subscriber.TrackLock.Lock()
+	defer subscriber.TrackLock.Unlock()
+
+	id := senderKey(publisher, publication.TrackID)
+	if _, ok := subscriber.Senders[id]; ok || subscriber.PeerConnection == nil {
+		return false
+	}
+	downTrack, err := publication.Subscribe(subscriber.ID.String())
+	if err != nil {
+		logger.LogError("Error creating down track", "error", err, "toPeerId", subscriber.ID.String(), "fromPeerId", publisher.ID.String())
+		return false
+	}
+	sender, err := subscriber.PeerConnection.AddTrack(downTrack.Track)
+	if err != nil {
+		publication.Unsubscribe(subscriber.ID.String())
+		logger.LogError("Error adding track to PeerConnection", "error", err, "toPeerId", subscriber.ID.String(), "fromPeerId", publisher.ID.String())
+		return false
+	}
+	subscriber.Senders[id] = sender
+	subscriber.Allocator.Add(downTrack)
+	go r.readRTCP(subscriber, sender, downTrack)
+	return true
+}
+
+// unsubscribe removes a publication's down track from the subscriber, it reports whether the
+// subscriber's session changed and needs a renegotiation
+func (r *Room) unsubscribe(subscriber, publisher *models.Peer, publication *sfu.Publication) bool {
+	if downTrack := publication.Unsubscribe(subscriber.ID.String()); downTrack != nil {
+		subscriber.Allocator.Remove(downTrack)
+	}
+
+	subscriber.TrackLock.Lock()
+	defer subscriber.TrackLock.Unlock()
+
+	id := senderKey(publisher, publication.TrackID)
+	sender, ok := subscriber.Senders[id]
+	if !ok {
+		return false
+	}
+	delete(subscriber.Senders, id)
+	if err := subscriber.PeerConnection.RemoveTrack(sender); err != nil {
+		if !errors.Is(err, webrtc.ErrConnectionClosed) {
+			logger.LogError("Error removing track from PeerConnection", "error", err, "peerId", subscriber.ID.String(), "fromPeerId", publisher.ID.String())
+		}
+		return false
+	}
+	return true
+}
+
+// dropSubscriptions forgets the down tracks of a peer that left, the caller holds ListLock
+func (r *Room) dropSubscriptions(p *models.Peer) {
+	for _, publisher := range r.Peers {
+		publisher.TrackLock.RLock()
+		for _, publication := range publisher.Publications {
+			publication.Unsubscribe(p.ID.String())
+		}
+		publisher.TrackLock.RUnlock()
+	}
+}
+
+// SetPreferredLayer picks the simulcast layer the subscriber receives of a publisher's video,
+// trackID narrows it down to one track (camera or screen share), empty means all of them
+func (r *Room) SetPreferredLayer(subscriber *models.Peer, request models.LayerRequestPayload) error {
+	quality, err := sfu.ParseQuality(request.Layer)
+	if err != nil {
+		return err
+	}
+	publisherID, err := uuid.Parse(request.PeerID)
+	if err != nil {
+		return ErrPeerNotInRoom
+	}
+	r.ListLock.RLock()
+	publisher, ok := r.Peers[publisherID]
+	r.ListLock.RUnlock()
+	if !ok || publisherID == subscriber.ID {
+		return ErrPeerNotInRoom
+	}
+
+	found := false
+	publisher.TrackLock.RLock()
+	defer publisher.TrackLock.RUnlock()
+	for _, publication := range publisher.Publications {
+		if publication.Kind != webrtc.RTPCodecTypeVideo || (request.TrackID != "" && request.TrackID != publication.TrackID) {
+			continue
+		}
+		if downTrack := publication.DownTrack(subscriber.ID.String()); downTrack != nil {
+			downTrack.SetPreferred(quality)
+			found = true
+		}
+	}
+	if !found {
+		return ErrTrackNotFound
+	}
+	return nil
+}
+
+// otherPeers snapshots every peer in the room but p
+func (r *Room) otherPeers(p *models.Peer) []*models.Peer {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+
+	peers := make([]*models.Peer, 0, len(r.Peers))
+	for _, peer := range r.Peers {
+		if peer.ID != p.ID {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,156 @@
+package room
+
+import (
+	"errors"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrNotWaiting       = errors.New("peer is not in the waiting list")
+	ErrAlreadyInWaiting = errors.New("peer is already in the waiting list")
+)
+
+// IsLocked reports whether new joiners have to be admitted by a moderator
+func (r *Room) IsLocked() bool {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	return r.AccessDetails != nil && r.AccessDetails.Locked
+}
+
+// SetLocked locks or unlocks the room and tells every participant about it
+func (r *Room) SetLocked(locked bool) {
+	r.ListLock.Lock()
+	r.AccessDetails.Locked = locked
+	r.ListLock.Unlock()
+	r.Broadcast(models.MessageTypeRoomLocked, models.RoomLockedPayload{Locked: locked}, nil)
+	logger.LogInfo("Room lock changed", "roomId", r.ID, "locked", locked)
+}
+
+// BypassesLock reports whether the peer may skip the waiting room: the authenticated creator
+// and peers whose join token grants them a moderator role
+func (r *Room) BypassesLock(p *models.Peer) bool {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	if p.GrantedRole == RoleOwner.String() || p.GrantedRole == RoleAdmin.String() {
+		return true
+	}
+	return r.ManagementDetails != nil && p.UserID != uuid.Nil && r.ManagementDetails.Creator == p.UserID
+}
+
+// signalModerators sends a message to every owner/admin currently in the room
+func (r *Room) signalModerators(event models.WebsocketMessageEvent, data interface{}) {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	for _, peer := range r.Peers {
+		if r.isModerator(peer.ID) {
+			SignalPeer(peer, event, data, true)
+		}
+	}
+}
+
+// ParkPeer puts a peer into the waiting list of a locked room. The peer only keeps its
+// signaling connection until a moderator admits it (see AdmitPeer) or denies it.
+func (r *Room) ParkPeer(displayName *string, ws *websocket.Conn, p *models.Peer) error {
+	if r == nil {
+		return ErrRoomIsNil
+	}
+	if !p.IsCreated() {
+		resetPeer(p, displayName, ws)
+	}
+
+	r.ListLock.Lock()
+	for _, waiting := range r.WaitingList {
+		if waiting.ID == p.ID {
+			r.ListLock.Unlock()
+			return ErrAlreadyInWaiting
+		}
+	}
+	r.WaitingList = append(r.WaitingList, p)
+	r.ListLock.Unlock()
+
+	SignalPeer(p, models.MessageTypeWaiting, p.ID.String(), true)
+	r.signalModerators(models.MessageTypeWaitingPeer, models.WaitingPeerPayload{
+		PeerID:      p.ID.String(),
+		DisplayName: p.DisplayName,
+	})
+	logger.LogInfo("Peer is waiting to be admitted", "peerId", p.ID.String(), "roomId", r.ID)
+	return nil
+}
+
+// WaitingPeers returns a snapshot of the waiting list
+func (r *Room) WaitingPeers() []models.WaitingPeerPayload {
+	r.ListLock.RLock()
+	defer r.ListLock.RUnlock()
+	waiting := make([]models.WaitingPeerPayload, 0, len(r.WaitingList))
+	for _, p := range r.WaitingList {
+		waiting = append(waiting, models.WaitingPeerPayload{PeerID: p.ID.String(), DisplayName: p.DisplayName})
+	}
+	return waiting
+}
+
+// AdmitPeer moves a waiting peer into the room, reusing its signaling connection
+func (r *Room) AdmitPeer(peerID uuid.UUID) (*models.Peer, error) {
+	p := r.removeWaitingPeer(peerID)
+	if p == nil {
+		return nil, ErrNotWaiting
+	}
+	if err := r.InitializePeer(p.ID.String(), p.DisplayName, p.WebSocket, p); err != nil {
+		return p, err
+	}
+	logger.LogInfo("Waiting peer admitted", "peerId", p.ID.String(), "roomId", r.ID)
+	return p, nil
+}
+
+// DenyPeer removes a waiting peer, tells it why and closes its signaling connection
+func (r *Room) DenyPeer(peerID uuid.UUID) error {
+	p := r.removeWaitingPeer(peerID)
+	if p == nil {
+		return ErrNotWaiting
+	}
+	SignalPeer(p, models.MessageTypeDenied, "a moderator denied your request to join", true)
+	p.WebSocket.Close()
+	logger.LogInfo("Waiting peer denied", "peerId", p.ID.String(), "roomId", r.ID)
+	return nil
+}
+
+// removeWaitingPeer takes a peer out of the waiting list and notifies the moderators.
+// It returns nil when the peer was not waiting.
+func (r *Room) removeWaitingPeer(peerID uuid.UUID) *models.Peer {
+	r.ListLock.Lock()
+	removed := r.removeWaitingPeerLocked(peerID)
+	r.ListLock.Unlock()
+
+	if removed != nil {
+		r.signalModerators(models.MessageTypeWaitingPeerRemoved, models.PeerTargetPayload{PeerID: peerID.String()})
+	}
+	return removed
+}
+
+// removeWaitingPeerLocked takes a peer out of the waiting list without telling anyone, nil when it
+// was not waiting. The caller holds the ListLock write lock and notifies the moderators after unlocking.
+func (r *Room) removeWaitingPeerLocked(peerID uuid.UUID) *models.Peer {
+	for i, p := range r.WaitingList {
+		if p.ID == peerID {
+			r.WaitingList = append(r.WaitingList[:i], r.WaitingList[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// denyAllWaiting turns away everyone still waiting, used when the room goes away
+func (r *Room) denyAllWaiting() {
+	r.ListLock.Lock()
+	waiting := r.WaitingList
+	r.WaitingList = nil
+	r.ListLock.Unlock()
+
+	for _, p := range waiting {
+		SignalPeer(p, models.MessageTypeDenied, "the room was closed", true)
+		p.WebSocket.Close()
+	}
+}
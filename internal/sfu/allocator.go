@@ -0,0 +1,130 @@
+package sfu
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Only this share of the estimate is handed out, the rest absorbs bitrate spikes and estimate noise
+const allocationHeadroom = 0.9
+
+// Allocator splits one subscriber's bandwidth between the tracks it receives. Every video track gets
+// its lowest layer first, then tracks are upgraded in priority order as far as the budget and the
+// subscriber's preferred quality allow.
+type Allocator struct {
+	lock       sync.Mutex
+	estimate   int // Send side (TWCC) estimate, 0 until known
+	remb       int // Latest REMB from the subscriber, 0 until one arrives
+	downTracks map[*DownTrack]struct{}
+}
+
+func NewAllocator() *Allocator {
+	return &Allocator{downTracks: make(map[*DownTrack]struct{})}
+}
+
+func (a *Allocator) Add(d *DownTrack) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.downTracks[d] = struct{}{}
+}
+
+func (a *Allocator) Remove(d *DownTrack) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.downTracks, d)
+}
+
+// SetEstimate records the congestion controller's target bitrate
+func (a *Allocator) SetEstimate(bitrate int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.estimate = bitrate
+}
+
+// SetREMB records the bandwidth the subscriber's browser says it can receive
+func (a *Allocator) SetREMB(bitrate int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.remb = bitrate
+}
+
+// Budget is the lower of the known estimates, 0 when there is none yet
+func (a *Allocator) Budget() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch {
+	case a.estimate == 0:
+		return a.remb
+	case a.remb == 0:
+		return a.estimate
+	}
+	return min(a.estimate, a.remb)
+}
+
+type allocation struct {
+	downTrack *DownTrack
+	priority  int
+	bitrates  []int
+	best      int // Best layer index the subscriber wants
+	index     int // Layer index granted
+}
+
+// Allocate hands out the budget again, priority ranks publications (higher goes first)
+func (a *Allocator) Allocate(priority func(*Publication) int) {
+	budget := float64(a.Budget()) * allocationHeadroom
+
+	a.lock.Lock()
+	downTracks := make([]*DownTrack, 0, len(a.downTracks))
+	for d := range a.downTracks {
+		downTracks = append(downTracks, d)
+	}
+	a.lock.Unlock()
+
+	if budget == 0 {
+		for _, d := range downTracks {
+			d.SetAllocation(-1) // Nothing to go by, let the preferences decide
+		}
+		return
+	}
+
+	var video []*allocation
+	for _, d := range downTracks {
+		layers, bitrates := d.pub.Bitrates()
+		if len(bitrates) == 0 {
+			continue
+		}
+		if d.pub.Kind != webrtc.RTPCodecTypeVideo {
+			budget -= float64(bitrates[0]) // Audio always goes through
+			continue
+		}
+		d.lock.Lock()
+		best := d.maxIndex(layers)
+		d.lock.Unlock()
+		video = append(video, &allocation{downTrack: d, priority: priority(d.pub), bitrates: bitrates, best: best})
+	}
+	slices.SortStableFunc(video, func(x, y *allocation) int {
+		if c := cmp.Compare(y.priority, x.priority); c != 0 {
+			return c
+		}
+		return cmp.Compare(x.downTrack.pub.TrackID, y.downTrack.pub.TrackID)
+	})
+
+	for _, v := range video {
+		budget -= float64(v.bitrates[0])
+	}
+	for _, v := range video {
+		for index := v.best; index > v.index; index-- {
+			if extra := float64(v.bitrates[index] - v.bitrates[v.index]); extra <= budget {
+				budget -= extra
+				v.index = index
+				break
+			}
+		}
+	}
+	for _, v := range video {
+		v.downTrack.SetAllocation(v.index)
+	}
+}
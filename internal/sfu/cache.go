@@ -0,0 +1,47 @@
+package sfu
+
+import (
+	"github.com/pion/rtp"
+)
+
+// Packets kept per video down track, a couple of seconds at typical camera bitrates
+const cacheSize = 512
+
+// PacketCache keeps the last packets sent on a down track, as sent, so the ones a subscriber
+// reports lost can be sent again without asking the publisher. It is not safe for concurrent use.
+type PacketCache struct {
+	slots []cacheSlot // By sequence number modulo the size
+}
+
+type cacheSlot struct {
+	seq  uint16
+	size int // 0 for an empty slot
+	data []byte
+}
+
+func NewPacketCache(size int) *PacketCache {
+	return &PacketCache{slots: make([]cacheSlot, size)}
+}
+
+// Put stores a copy of the packet, replacing the one that used its slot
+func (c *PacketCache) Put(pkt *rtp.Packet) {
+	slot := &c.slots[int(pkt.SequenceNumber)%len(c.slots)]
+	if cap(slot.data) < pkt.MarshalSize() {
+		slot.data = make([]byte, max(pkt.MarshalSize(), 1500))
+	}
+	n, err := pkt.MarshalTo(slot.data[:cap(slot.data)])
+	if err != nil {
+		slot.size = 0
+		return
+	}
+	slot.seq, slot.size = pkt.SequenceNumber, n
+}
+
+// Get returns a copy of the packet sent with the sequence number, nil once it was overwritten
+func (c *PacketCache) Get(seq uint16) []byte {
+	slot := &c.slots[int(seq)%len(c.slots)]
+	if slot.size == 0 || slot.seq != seq {
+		return nil
+	}
+	return append([]byte(nil), slot.data[:slot.size]...)
+}
@@ -0,0 +1,137 @@
+package sfu
+
+import (
+	"errors"
+)
+
+var (
+	errShortDescriptor = errors.New("dependency descriptor too short")
+	errNoStructure     = errors.New("dependency descriptor refers to an unknown template structure")
+)
+
+// dependencyStructure is the part of a template dependency structure the forwarder needs: the layer
+// of every frame template. Publishers send it on keyframes, later descriptors refer to its templates.
+type dependencyStructure struct {
+	templateIDOffset int
+	templates        []svcLayer
+	maxLayer         svcLayer // Highest spatial and temporal ids of the templates
+}
+
+// parseDependencyDescriptor reads a frame's layer from its dependency descriptor. structure is the
+// stream's latest template structure, a descriptor carrying a new one returns it as next.
+func parseDependencyDescriptor(data []byte, structure *dependencyStructure) (frame frameInfo, next *dependencyStructure, err error) {
+	r := bitReader{data: data}
+	start := r.read(1)
+	end := r.read(1)
+	templateID := int(r.read(6))
+	r.read(16) // Frame number
+	if len(data) > 3 && r.read(1) == 1 {
+		// The rest of the extended fields (active decode targets, custom dependencies) don't change the layer
+		next = readDependencyStructure(&r)
+		structure = next
+	}
+	if r.err != nil {
+		return frame, nil, r.err
+	}
+	if structure == nil {
+		return frame, nil, errNoStructure
+	}
+	index := (templateID + 64 - structure.templateIDOffset) % 64
+	if index >= len(structure.templates) {
+		return frame, next, errNoStructure
+	}
+	return frameInfo{
+		layer:      structure.templates[index],
+		layered:    true,
+		beginFrame: start == 1,
+		endFrame:   end == 1,
+		pictureID:  -1,
+		layers:     structure.maxLayer,
+	}, next, nil
+}
+
+// readDependencyStructure reads a template_dependency_structure, see the AV1 RTP specification
+func readDependencyStructure(r *bitReader) *dependencyStructure {
+	// The flags for active decode targets and custom dtis, fdiffs and chains come first
+	r.read(4)
+	s := &dependencyStructure{templateIDOffset: int(r.read(6))}
+	decodeTargets := int(r.read(5)) + 1
+
+	var layer svcLayer
+	for r.err == nil && len(s.templates) < 64 {
+		s.templates = append(s.templates, layer)
+		s.maxLayer.spatial = max(s.maxLayer.spatial, layer.spatial)
+		s.maxLayer.temporal = max(s.maxLayer.temporal, layer.temporal)
+		next := r.read(2)
+		if next == 3 {
+			break
+		}
+		switch next {
+		case 1: // Next temporal layer
+			layer.temporal++
+		case 2: // Next spatial layer
+			layer = svcLayer{spatial: layer.spatial + 1}
+		}
+	}
+
+	r.skip(len(s.templates) * decodeTargets * 2) // Decode target indications
+	for range s.templates {
+		for r.err == nil && r.read(1) == 1 { // Frame diffs
+			r.read(4)
+		}
+	}
+	if chains := r.readNonSymmetric(uint32(decodeTargets) + 1); chains > 0 {
+		for range decodeTargets {
+			r.readNonSymmetric(chains) // Protecting chain
+		}
+		r.skip(len(s.templates) * int(chains) * 4) // Chain diffs
+	}
+	if r.read(1) == 1 { // Render resolutions
+		r.skip((s.maxLayer.spatial + 1) * 32)
+	}
+	return s
+}
+
+// bitReader reads big endian bit fields, the first error sticks and every later read returns 0
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+	err  error
+}
+
+func (r *bitReader) read(n int) uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = errShortDescriptor
+		return 0
+	}
+	var v uint32
+	for range n {
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	if r.err == nil && r.pos+n > len(r.data)*8 {
+		r.err = errShortDescriptor
+	}
+	r.pos += n
+}
+
+// readNonSymmetric reads a value below n with the spec's ns(n) encoding
+func (r *bitReader) readNonSymmetric(n uint32) uint32 {
+	w := 0
+	for x := n; x != 0; x >>= 1 {
+		w++
+	}
+	m := uint32(1)<<w - n
+	v := r.read(w - 1)
+	if v < m {
+		return v
+	}
+	return v<<1 - m + r.read(1)
+}
@@ -0,0 +1,133 @@
+package sfu
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Dependency descriptors as AV1 publishers send them, see the AV1 RTP specification appendix A
+var (
+	// Keyframe of an L1T3 stream with its template structure: template id offset 0, 3 decode
+	// targets, templates T0 T0 T1 T2 T2, one chain and a 640x360 render resolution
+	ddL1T3Key = "c003e8800214c0000000410410200001027f0167"
+	ddL1T3T1  = "c203e9" // Template 2
+	ddL1T3T2  = "c303e9" // Template 3
+
+	// Keyframe of an L3T3 stream: template id offset 10, 9 decode targets, templates S0T0 S0T1
+	// S0T2 S1T0 S1T1 S1T2 S2T0 S2T1 S2T2, no chains and no resolutions
+	ddL3T3Key   = "8a000581485965c000000000000000000000000000000000000000000000"
+	ddL3T3S1T2  = "8f0006" // Template id 15, first packet of the frame
+	ddL3T3S2T2  = "520006" // Template id 18, last packet of the frame
+	ddL3T3S0T0  = "ca0007" // Template id 10, the whole frame in one packet
+	ddL3T3S1T0  = "cd0007" // Template id 13
+	ddL3T3S2T0  = "d00007" // Template id 16
+	ddL3T3Wrong = "930006" // Template id 19, past the structure's 9 templates
+)
+
+func fixture(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseDependencyDescriptor(t *testing.T) {
+	l1t3, l3t3 := svcLayer{temporal: 2}, svcLayer{spatial: 2, temporal: 2}
+	tests := []struct {
+		name      string
+		structure string // Descriptor carrying the structure the others refer to, empty for none
+		data      string
+		err       error
+		want      frameInfo
+	}{
+		{
+			name: "L1T3 keyframe",
+			data: ddL1T3Key,
+			want: frameInfo{layered: true, layers: l1t3, beginFrame: true, endFrame: true, pictureID: -1},
+		},
+		{
+			name:      "L1T3 T1",
+			structure: ddL1T3Key,
+			data:      ddL1T3T1,
+			want:      frameInfo{layer: svcLayer{temporal: 1}, layered: true, layers: l1t3, beginFrame: true, endFrame: true, pictureID: -1},
+		},
+		{
+			name:      "L1T3 T2",
+			structure: ddL1T3Key,
+			data:      ddL1T3T2,
+			want:      frameInfo{layer: svcLayer{temporal: 2}, layered: true, layers: l1t3, beginFrame: true, endFrame: true, pictureID: -1},
+		},
+		{
+			name: "L3T3 keyframe",
+			data: ddL3T3Key,
+			want: frameInfo{layered: true, layers: l3t3, beginFrame: true, pictureID: -1},
+		},
+		{
+			name:      "L3T3 S1T2 with template id offset",
+			structure: ddL3T3Key,
+			data:      ddL3T3S1T2,
+			want:      frameInfo{layer: svcLayer{spatial: 1, temporal: 2}, layered: true, layers: l3t3, beginFrame: true, pictureID: -1},
+		},
+		{
+			name:      "L3T3 S2T2 end of frame",
+			structure: ddL3T3Key,
+			data:      ddL3T3S2T2,
+			want:      frameInfo{layer: svcLayer{spatial: 2, temporal: 2}, layered: true, layers: l3t3, endFrame: true, pictureID: -1},
+		},
+		{name: "template outside the structure", structure: ddL3T3Key, data: ddL3T3Wrong, err: errNoStructure},
+		{name: "no structure yet", data: ddL1T3T1, err: errNoStructure},
+		{name: "too short", data: "c003", err: errShortDescriptor},
+		{name: "truncated structure", data: ddL1T3Key[:12], err: errShortDescriptor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var structure *dependencyStructure
+			if tt.structure != "" {
+				_, next, err := parseDependencyDescriptor(fixture(t, tt.structure), nil)
+				if err != nil || next == nil {
+					t.Fatalf("structure: %v", err)
+				}
+				structure = next
+			}
+			frame, next, err := parseDependencyDescriptor(fixture(t, tt.data), structure)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if frame != tt.want {
+				t.Fatalf("got %+v, want %+v", frame, tt.want)
+			}
+			if (next != nil) != (tt.structure == "") {
+				t.Fatalf("structure returned: %v, want one only from a descriptor carrying it", next != nil)
+			}
+		})
+	}
+}
+
+func TestReadNonSymmetric(t *testing.T) {
+	// ns(5) codes 0-2 in two bits and 3-4 in three, see the AV1 specification section 4.10.7
+	tests := []struct {
+		bits string
+		want uint32
+	}{
+		{"00", 0}, {"01", 1}, {"10", 2}, {"110", 3}, {"111", 4},
+	}
+	for _, tt := range tests {
+		var data byte
+		for i, c := range tt.bits {
+			if c == '1' {
+				data |= 0x80 >> i
+			}
+		}
+		r := bitReader{data: []byte{data}}
+		if got := r.readNonSymmetric(5); got != tt.want || r.pos != len(tt.bits) {
+			t.Errorf("%s: got %d after %d bits, want %d after %d", tt.bits, got, r.pos, tt.want, len(tt.bits))
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package sfu
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// DownTrack forwards one publication to one subscriber. It owns its local track, so each subscriber
+// can receive a different layer, and a Rewriter so layer switches and publisher restarts look like
+// one continuous stream. The SSRC is rewritten by the local track itself.
+type DownTrack struct {
+	Track        *webrtc.TrackLocalStaticRTP
+	SubscriberID string
+
+	pub      *Publication
+	rewriter *Rewriter
+	cache    *PacketCache // Video only, nil for audio
+
+	lock      sync.Mutex
+	preferred Quality
+	allocated int    // Highest layer index the allocator lets through, -1 without a limit
+	current   string // RID being forwarded
+	target    string // RID to switch to on its next keyframe
+	waiting   bool   // Nothing is forwarded until the target's next keyframe
+	svc       svcFilter
+	stats     ReceiverStats
+}
+
+// Preferred returns the quality the subscriber asked for
+func (d *DownTrack) Preferred() Quality {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.preferred
+}
+
+// Layer returns the RID currently forwarded and the one being switched to, for a scalable stream
+// the spatial and temporal layers
+func (d *DownTrack) Layer() (current, target string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.svc.enabled {
+		if !d.waiting {
+			current = d.svc.current.String()
+		}
+		return current, d.svc.target.String()
+	}
+	return d.current, d.target
+}
+
+// RequestKeyframe asks the publisher for a keyframe of the layer the subscriber receives, or is
+// switching to, on its behalf
+func (d *DownTrack) RequestKeyframe() {
+	d.lock.Lock()
+	rid := d.current
+	if d.waiting {
+		rid = d.target
+	}
+	d.lock.Unlock()
+	d.pub.RequestKeyframe(rid)
+}
+
+// SetPreferred changes the quality the subscriber wants, an upper bound for the allocator. The
+// switch happens on the new layer's next keyframe which is requested right away.
+func (d *DownTrack) SetPreferred(q Quality) {
+	d.update(func() { d.preferred = q })
+}
+
+// SetAllocation caps the layer index the subscriber receives, -1 lifts the cap
+func (d *DownTrack) SetAllocation(index int) {
+	d.update(func() { d.allocated = index })
+}
+
+func (d *DownTrack) update(change func()) {
+	layers := d.pub.Layers()
+
+	d.lock.Lock()
+	change()
+	switched := d.retarget(layers)
+	target := d.target
+	d.lock.Unlock()
+
+	if switched {
+		d.pub.RequestKeyframe(target)
+	}
+}
+
+// maxIndex is the best quality step the subscriber wants, the caller holds lock
+func (d *DownTrack) maxIndex(layers layout) int {
+	if layers.svc != nil {
+		return svcQualityIndex(layers.svc, d.preferred)
+	}
+	return qualityIndex(len(layers.rids), d.preferred)
+}
+
+// retarget picks the target layer from the preference and the allocation, the caller holds lock
+func (d *DownTrack) retarget(layers layout) bool {
+	d.svc.enabled = layers.svc != nil
+	if len(layers.rids) == 0 {
+		return d.setTarget("")
+	}
+	index := d.maxIndex(layers)
+	if d.allocated >= 0 && d.allocated < index {
+		index = d.allocated
+	}
+	if !d.svc.enabled {
+		return d.setTarget(layers.rids[index])
+	}
+	switched := d.setTarget(layers.rids[0])
+	return d.svc.setTarget(layers.svc[index]) || switched
+}
+
+// setTarget reports whether the down track now waits for a keyframe on another layer, the caller holds lock
+func (d *DownTrack) setTarget(rid string) bool {
+	if rid == d.target && (d.current == rid || d.waiting) {
+		return false
+	}
+	d.target = rid
+	if d.current == rid {
+		d.waiting = false
+		return false
+	}
+	d.waiting = true
+	return true
+}
+
+// writeRTP forwards the packet if it belongs to the layer the subscriber receives, switching layers
+// on the first keyframe of the target. frame is set for scalable streams, the packet also has to
+// belong to the spatial and temporal layers the subscriber receives.
+func (d *DownTrack) writeRTP(rid string, pkt *rtp.Packet, isKeyframe func() bool, frame *frameInfo) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.waiting && rid == d.target && isKeyframe() {
+		d.current = rid
+		d.waiting = false
+		d.svc.current = d.svc.target
+		d.rewriter.Resync()
+	}
+	if rid != d.current || (d.waiting && d.current == "") {
+		return nil
+	}
+	layered := frame != nil && d.svc.enabled
+	if layered && !d.svc.admit(frame, isKeyframe) {
+		d.rewriter.Drop(&pkt.Header)
+		return nil
+	}
+	picture := -1
+	if layered && frame.pictureID >= 0 {
+		var known bool
+		if picture, known = d.svc.renumber(frame.pictureID, frame.pictureBits); !known {
+			d.rewriter.Drop(&pkt.Header)
+			return nil
+		}
+	}
+
+	seq, ts, ok := d.rewriter.Rewrite(&pkt.Header, time.Now())
+	if !ok {
+		return nil
+	}
+	out := *pkt
+	out.SequenceNumber = seq
+	out.Timestamp = ts
+	// The publisher's header extension ids mean nothing on the subscriber's session
+	out.Extension = false
+	out.Extensions = nil
+	if layered {
+		// The last forwarded layer ends the picture for this subscriber
+		out.Marker = pkt.Marker || (frame.endFrame && frame.layer.spatial == d.svc.current.spatial)
+		if picture >= 0 {
+			out.Payload = slices.Clone(pkt.Payload) // Shared with the other subscribers
+			setVP9PictureID(out.Payload, picture, frame.pictureBits)
+		}
+	}
+	if d.cache != nil {
+		d.cache.Put(&out)
+	}
+	return d.Track.WriteRTP(&out)
+}
+
+// Retransmit sends the packets a subscriber reported lost again from the cache, it returns how
+// many it sent and how many were too old to still be there
+func (d *DownTrack) Retransmit(seqs []uint16) (sent, missed int) {
+	if d.cache == nil {
+		return 0, len(seqs)
+	}
+	packets := make([][]byte, 0, len(seqs))
+	d.lock.Lock()
+	for _, seq := range seqs {
+		if packet := d.cache.Get(seq); packet != nil {
+			packets = append(packets, packet)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, packet := range packets {
+		if _, err := d.Track.Write(packet); err != nil {
+			break
+		}
+		sent++
+	}
+	return sent, len(seqs) - sent
+}
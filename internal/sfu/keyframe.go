@@ -0,0 +1,65 @@
+package sfu
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// H.264 NAL unit types we care about
+const (
+	naluIDR   = 5
+	naluSPS   = 7
+	naluSTAPA = 24
+	naluFUA   = 28
+)
+
+// IsKeyframe reports whether the payload starts a keyframe, the only safe place to switch a
+// subscriber to another layer. Codecs we can't inspect are treated as always switchable.
+func IsKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		// First packet of the frame and the P bit of the frame tag is clear
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B && vp9.SID == 0
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		// N bit of the aggregation header: first packet of a new coded video sequence
+		return len(payload) > 0 && payload[0]&0x08 != 0
+	}
+	return true
+}
+
+func h264Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch nalu := payload[0] & 0x1F; nalu {
+	case naluIDR, naluSPS:
+		return true
+	case naluSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1F; t == naluIDR || t == naluSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case naluFUA:
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1F
+		return start && (t == naluIDR || t == naluSPS)
+	}
+	return false
+}
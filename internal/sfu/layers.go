@@ -0,0 +1,75 @@
+package sfu
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// Quality is the simulcast layer a subscriber asks for, mapped onto whatever RIDs the publisher sends
+type Quality int
+
+const (
+	QualityLow Quality = iota
+	QualityMid
+	QualityHigh
+)
+
+var ErrInvalidQuality = errors.New(`layer must be "low", "mid" or "high"`)
+
+func ParseQuality(s string) (Quality, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return QualityLow, nil
+	case "mid":
+		return QualityMid, nil
+	case "high":
+		return QualityHigh, nil
+	}
+	return 0, ErrInvalidQuality
+}
+
+func (q Quality) String() string {
+	switch q {
+	case QualityLow:
+		return "low"
+	case QualityMid:
+		return "mid"
+	}
+	return "high"
+}
+
+// ridRanks orders the RIDs browsers and libraries commonly use, lowest resolution first
+var ridRanks = map[string]int{
+	"q": 0, "l": 0, "low": 0, "0": 0,
+	"h": 1, "m": 1, "mid": 1, "1": 1,
+	"f": 2, "high": 2, "2": 2,
+}
+
+// sortLayers orders RIDs from the lowest to the highest quality, unknown RIDs sort by name after the known ones
+func sortLayers(rids []string) {
+	slices.SortFunc(rids, func(a, b string) int {
+		ra, okA := ridRanks[strings.ToLower(a)]
+		rb, okB := ridRanks[strings.ToLower(b)]
+		switch {
+		case okA && okB:
+			return ra - rb
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+}
+
+// qualityIndex maps a quality onto n sorted layers: high is the best one, low the worst, mid the one in between
+func qualityIndex(n int, q Quality) int {
+	switch q {
+	case QualityLow:
+		return 0
+	case QualityMid:
+		return n / 2
+	}
+	return n - 1
+}
@@ -0,0 +1,68 @@
+package sfu
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lost packets are asked for again this often, a few times at most, and a gap wider than
+// maxMissing is a restart or an outage not worth repairing
+const (
+	nackInterval = 100 * time.Millisecond
+	nackTries    = 3
+	maxMissing   = 128
+)
+
+// lossTracker finds the gaps in the sequence numbers a layer receives and decides which missing
+// packets to ask the publisher for
+type lossTracker struct {
+	lock    sync.Mutex
+	started bool
+	highest uint16
+	missing map[uint16]*missingPacket
+}
+
+type missingPacket struct {
+	tries   int
+	askedAt time.Time
+}
+
+func newLossTracker() *lossTracker {
+	return &lossTracker{missing: make(map[uint16]*missingPacket)}
+}
+
+// push records a received packet and returns the sequence numbers that are due for a NACK
+func (l *lossTracker) push(seq uint16, now time.Time) []uint16 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch delta := int(int16(seq - l.highest)); {
+	case !l.started || delta > maxMissing || delta < -maxMissing:
+		l.started = true
+		l.highest = seq
+		clear(l.missing)
+	case delta > 0:
+		for missing := l.highest + 1; missing != seq; missing++ {
+			l.missing[missing] = &missingPacket{}
+		}
+		l.highest = seq
+	default:
+		delete(l.missing, seq) // Reordered or retransmitted
+	}
+
+	var due []uint16
+	for missing, packet := range l.missing {
+		if int(int16(l.highest-missing)) > maxMissing || packet.tries >= nackTries {
+			delete(l.missing, missing) // Given up on
+			continue
+		}
+		if now.Sub(packet.askedAt) >= nackInterval {
+			packet.tries++
+			packet.askedAt = now
+			due = append(due, missing)
+		}
+	}
+	slices.SortFunc(due, func(a, b uint16) int { return int(int16(a - b)) })
+	return due
+}
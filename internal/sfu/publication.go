@@ -0,0 +1,488 @@
+package sfu
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"video_conferencing_server/internal/logger"
+	"video_conferencing_server/internal/metrics"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrAlreadySubscribed = errors.New("already subscribed to this track")
+
+// Publication is one track a peer publishes. Simulcast publishers send it as several remote
+// tracks (layers) sharing the track id and told apart by RID, without simulcast there is a single
+// layer with an empty RID. Every subscriber gets its own DownTrack.
+type Publication struct {
+	ID       string // Track id the publisher uses
+	TrackID  string // Track id subscribers see
+	StreamID string
+	Kind     webrtc.RTPCodecType
+	Codec    webrtc.RTPCodecParameters
+
+	PublisherID string
+	Screen      bool // Screen share rather than camera or microphone
+
+	writeRTCP        func([]rtcp.Packet) error // To the publisher
+	keyframeInterval time.Duration             // Least time between two keyframe requests for a layer
+
+	keyframeLock sync.Mutex
+	keyframes    map[string]*keyframeRequest // By RID
+
+	lock       sync.RWMutex
+	layers     map[string]*webrtc.TrackRemote // By RID
+	order      []string                       // RIDs from the lowest to the highest quality
+	downTracks map[string]*DownTrack          // By subscriber id
+	rates      map[string]*layerRate          // By RID
+	losses     map[string]*lossTracker        // By RID, video only
+	measuredAt time.Time
+
+	// A single VP9 or AV1 layer can be scalable: subscribers then get some of its spatial and temporal layers
+	svcLayers    svcLayer // Highest layers seen, guarded by lock
+	svcRates     [maxSpatialLayers][maxTemporalLayers]layerRate
+	dependencyID atomic.Uint32                       // AV1 dependency descriptor extension id, 0 if not negotiated
+	dependencies atomic.Pointer[dependencyStructure] // Latest AV1 template structure
+}
+
+// keyframeRequest throttles the keyframe requests for one layer
+type keyframeRequest struct {
+	sentAt  time.Time
+	pending bool // One is scheduled for when the interval is over
+}
+
+// layerRate measures what a layer costs to forward
+type layerRate struct {
+	bytes   atomic.Uint64 // Since measuredAt
+	bitrate int           // Over the last measurement interval
+}
+
+// How often layer bitrates are measured, and what is assumed before the first measurement
+// (lowest to highest layer, audio uses the first one)
+const rateInterval = 500 * time.Millisecond
+
+const defaultAudioBitrate = 50_000
+
+var defaultLayerBitrates = []int{150_000, 500_000, 1_500_000}
+
+// NewPublication starts a publication from its first remote track, writeRTCP sends feedback
+// (keyframe requests, NACKs) to the publisher. Keyframe requests for a layer are at least
+// keyframeInterval apart.
+func NewPublication(publisherID, trackID, streamID string, screen bool, remote *webrtc.TrackRemote, keyframeInterval time.Duration, writeRTCP func([]rtcp.Packet) error) *Publication {
+	p := &Publication{
+		ID:               remote.ID(),
+		TrackID:          trackID,
+		StreamID:         streamID,
+		Kind:             remote.Kind(),
+		Codec:            remote.Codec(),
+		PublisherID:      publisherID,
+		Screen:           screen,
+		writeRTCP:        writeRTCP,
+		keyframeInterval: keyframeInterval,
+		keyframes:        make(map[string]*keyframeRequest),
+		layers:           make(map[string]*webrtc.TrackRemote),
+		downTracks:       make(map[string]*DownTrack),
+		rates:            make(map[string]*layerRate),
+		losses:           make(map[string]*lossTracker),
+		measuredAt:       time.Now(),
+	}
+	p.AddLayer(remote)
+	return p
+}
+
+// AddLayer records another simulcast layer and moves subscribers that were waiting for it. A remote
+// track replacing a layer (the publisher restarted it) takes over from the next keyframe.
+func (p *Publication) AddLayer(remote *webrtc.TrackRemote) {
+	p.lock.Lock()
+	previous, restarted := p.layers[remote.RID()]
+	if restarted && previous != remote {
+		p.detach(remote.RID())
+	}
+	p.layers[remote.RID()] = remote
+	if p.Kind == webrtc.RTPCodecTypeVideo {
+		p.losses[remote.RID()] = newLossTracker() // A restarted layer numbers its packets afresh
+	}
+	if !slices.Contains(p.order, remote.RID()) {
+		p.order = append(p.order, remote.RID())
+		p.rates[remote.RID()] = &layerRate{}
+	}
+	sortLayers(p.order)
+	retargeted := p.retarget()
+	if restarted {
+		retargeted = append(retargeted, remote.RID()) // The detached subscribers wait on it
+	}
+	p.lock.Unlock()
+
+	p.requestKeyframes(retargeted)
+}
+
+// RemoveLayer drops a layer whose remote track ended, it reports whether the publication has none
+// left. Nothing changes when the layer was already taken over by another remote track.
+func (p *Publication) RemoveLayer(remote *webrtc.TrackRemote) bool {
+	rid := remote.RID()
+	p.lock.Lock()
+	if p.layers[rid] != remote {
+		p.lock.Unlock()
+		return false
+	}
+	delete(p.layers, rid)
+	delete(p.rates, rid)
+	delete(p.losses, rid)
+	p.order = slices.DeleteFunc(p.order, func(r string) bool { return r == rid })
+	p.detach(rid)
+	retargeted := p.retarget()
+	empty := len(p.layers) == 0
+	p.lock.Unlock()
+
+	p.requestKeyframes(retargeted)
+	return empty
+}
+
+// detach stops the down tracks forwarding a layer, nothing goes out until the new target's next
+// keyframe. The caller holds the write lock.
+func (p *Publication) detach(rid string) {
+	for _, d := range p.downTracks {
+		d.lock.Lock()
+		if d.current == rid {
+			d.current = ""
+			d.waiting = true
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Resume has every subscriber wait for a keyframe of its target layer and requests those, for
+// when forwarding starts again after a pause: the next frames reference ones nobody received.
+// The packets skipped during the pause aren't losses to ask the publisher for.
+func (p *Publication) Resume() {
+	p.lock.Lock()
+	for _, rid := range p.order {
+		p.detach(rid)
+		if _, ok := p.losses[rid]; ok {
+			p.losses[rid] = newLossTracker()
+		}
+	}
+	var targets []string
+	for _, d := range p.downTracks {
+		d.lock.Lock()
+		targets = append(targets, d.target)
+		d.lock.Unlock()
+	}
+	p.lock.Unlock()
+
+	p.requestKeyframes(targets)
+}
+
+// retarget points every down track at the layer matching its preference, it returns the layers
+// that now have subscribers waiting for a keyframe. The caller holds the write lock.
+func (p *Publication) retarget() []string {
+	var waiting []string
+	layers := p.layout()
+	for _, d := range p.downTracks {
+		d.lock.Lock()
+		if d.retarget(layers) {
+			waiting = append(waiting, d.target)
+		}
+		d.lock.Unlock()
+	}
+	return waiting
+}
+
+// Layers returns the quality steps of the publication, from the lowest to the highest
+func (p *Publication) Layers() layout {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.layout()
+}
+
+// layout is the simulcast layers being received or the ladder of a scalable one, the caller holds lock
+func (p *Publication) layout() layout {
+	layers := layout{rids: slices.Clone(p.order)}
+	if len(p.order) == 1 && p.svcLayers != (svcLayer{}) {
+		layers.svc = svcLadder(p.svcLayers)
+	}
+	return layers
+}
+
+// Bitrates returns the quality steps from the lowest to the highest with what each one costs in
+// bits per second, steps not measured yet get a typical value
+func (p *Publication) Bitrates() (layout, []int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if elapsed := time.Since(p.measuredAt); elapsed >= rateInterval {
+		for _, rate := range p.rates {
+			rate.measure(elapsed)
+		}
+		for s := range p.svcRates {
+			for t := range p.svcRates[s] {
+				p.svcRates[s][t].measure(elapsed)
+			}
+		}
+		p.measuredAt = time.Now()
+	}
+	layers := p.layout()
+	bitrates := make([]int, layers.steps())
+	for i := range bitrates {
+		if layers.svc != nil {
+			bitrates[i] = p.svcBitrate(layers.svc[i])
+		} else {
+			bitrates[i] = p.rates[layers.rids[i]].bitrate
+		}
+		if bitrates[i] == 0 {
+			bitrates[i] = p.defaultBitrate(i, len(bitrates))
+		}
+	}
+	return layers, bitrates
+}
+
+func (r *layerRate) measure(elapsed time.Duration) {
+	r.bitrate = int(float64(r.bytes.Swap(0)*8) / elapsed.Seconds())
+}
+
+// svcBitrate is what forwarding up to the layer costs, every layer below included. The caller holds lock.
+func (p *Publication) svcBitrate(layer svcLayer) int {
+	bitrate := 0
+	for s := 0; s <= layer.spatial; s++ {
+		for t := 0; t <= layer.temporal; t++ {
+			bitrate += p.svcRates[s][t].bitrate
+		}
+	}
+	return bitrate
+}
+
+// defaultBitrate guesses the cost of layer i out of n, the best layer being the most expensive one
+func (p *Publication) defaultBitrate(i, n int) int {
+	if p.Kind == webrtc.RTPCodecTypeAudio {
+		return defaultAudioBitrate
+	}
+	return defaultLayerBitrates[max(0, i+len(defaultLayerBitrates)-n)]
+}
+
+// Simulcast reports whether the publisher sends more than one layer
+func (p *Publication) Simulcast() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.layers) > 1
+}
+
+// RequestKeyframe asks the publisher for a keyframe on one layer. A request too soon after the
+// previous one is sent once the interval is over, together with any other made in between.
+func (p *Publication) RequestKeyframe(rid string) {
+	if p.Kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	p.keyframeLock.Lock()
+	request, ok := p.keyframes[rid]
+	if !ok {
+		request = &keyframeRequest{}
+		p.keyframes[rid] = request
+	}
+	if request.pending {
+		p.keyframeLock.Unlock()
+		metrics.KeyframeRequestsThrottled.Add(1)
+		return
+	}
+	if wait := p.keyframeInterval - time.Since(request.sentAt); wait > 0 {
+		request.pending = true
+		p.keyframeLock.Unlock()
+		metrics.KeyframeRequestsThrottled.Add(1)
+		time.AfterFunc(wait, func() {
+			p.keyframeLock.Lock()
+			request.pending = false
+			request.sentAt = time.Now()
+			p.keyframeLock.Unlock()
+			p.sendPLI(rid)
+		})
+		return
+	}
+	request.sentAt = time.Now()
+	p.keyframeLock.Unlock()
+	p.sendPLI(rid)
+}
+
+// sendPLI sends a keyframe request for the layer's current SSRC, if the layer is still there
+func (p *Publication) sendPLI(rid string) {
+	p.lock.RLock()
+	remote, ok := p.layers[rid]
+	p.lock.RUnlock()
+	if !ok {
+		return
+	}
+	metrics.KeyframeRequests.Add(1)
+	if err := p.writeRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}}); err != nil {
+		logger.LogError("Error requesting keyframe", "error", err, "trackId", p.TrackID, "peerId", p.PublisherID)
+	}
+}
+
+func (p *Publication) requestKeyframes(rids []string) {
+	for _, rid := range slices.Compact(slices.Sorted(slices.Values(rids))) {
+		p.RequestKeyframe(rid)
+	}
+}
+
+// Subscribe creates the subscriber's DownTrack, starting on the highest layer
+func (p *Publication) Subscribe(subscriberID string) (*DownTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(p.Codec.RTPCodecCapability, p.TrackID, p.StreamID)
+	if err != nil {
+		return nil, err
+	}
+	d := &DownTrack{
+		Track:        track,
+		SubscriberID: subscriberID,
+		pub:          p,
+		preferred:    QualityHigh,
+		allocated:    -1,
+		rewriter:     NewRewriter(p.Codec.ClockRate),
+		waiting:      true,
+	}
+	if p.Kind == webrtc.RTPCodecTypeVideo {
+		d.cache = NewPacketCache(cacheSize)
+	}
+
+	p.lock.Lock()
+	if _, ok := p.downTracks[subscriberID]; ok {
+		p.lock.Unlock()
+		return nil, ErrAlreadySubscribed
+	}
+	p.downTracks[subscriberID] = d
+	d.retarget(p.layout())
+	target := d.target
+	p.lock.Unlock()
+
+	p.RequestKeyframe(target) // The subscriber can't decode anything before one
+	return d, nil
+}
+
+// Unsubscribe forgets the subscriber's DownTrack and returns it, nil if there was none
+func (p *Publication) Unsubscribe(subscriberID string) *DownTrack {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d := p.downTracks[subscriberID]
+	delete(p.downTracks, subscriberID)
+	return d
+}
+
+// DownTrack returns the subscriber's DownTrack, nil if it isn't subscribed
+func (p *Publication) DownTrack(subscriberID string) *DownTrack {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.downTracks[subscriberID]
+}
+
+// SetDependencyDescriptorID sets the header extension id the publisher's AV1 dependency descriptors
+// use, which is how AV1 packets are told apart by layer
+func (p *Publication) SetDependencyDescriptorID(id uint8) {
+	p.dependencyID.Store(uint32(id))
+}
+
+// Forward hands a packet received on one layer to every subscriber, each one decides whether
+// that is the layer it currently receives. Gaps in the layer's sequence numbers are NACKed.
+func (p *Publication) Forward(rid string, pkt *rtp.Packet) {
+	checked, keyframe := false, false
+	isKeyframe := func() bool {
+		if !checked {
+			keyframe, checked = IsKeyframe(p.Codec.MimeType, pkt.Payload), true
+		}
+		return keyframe
+	}
+
+	frame := p.parseFrame(pkt)
+	if frame != nil {
+		p.lock.RLock()
+		grown := len(p.order) == 1 && p.highestLayers(frame) != p.svcLayers
+		p.lock.RUnlock()
+		if grown {
+			p.addSVCLayers(frame)
+		}
+	}
+
+	p.lock.RLock()
+	size := uint64(pkt.MarshalSize())
+	if rate, ok := p.rates[rid]; ok {
+		rate.bytes.Add(size)
+	}
+	if len(p.order) != 1 {
+		frame = nil // Simulcast layers are switched as a whole
+	} else if frame != nil && frame.layer.spatial < maxSpatialLayers && frame.layer.temporal < maxTemporalLayers {
+		p.svcRates[frame.layer.spatial][frame.layer.temporal].bytes.Add(size)
+	}
+	var lost []uint16
+	if loss, ok := p.losses[rid]; ok {
+		lost = loss.push(pkt.SequenceNumber, time.Now())
+	}
+	for _, d := range p.downTracks {
+		if err := d.writeRTP(rid, pkt, isKeyframe, frame); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			logger.LogError("Error writing to down track", "error", err, "trackId", p.TrackID, "subscriberId", d.SubscriberID)
+		}
+	}
+	p.lock.RUnlock()
+
+	if len(lost) > 0 {
+		metrics.NacksSent.Add(int64(len(lost)))
+		nack := &rtcp.TransportLayerNack{MediaSSRC: pkt.SSRC, Nacks: rtcp.NackPairsFromSequenceNumbers(lost)}
+		if err := p.writeRTCP([]rtcp.Packet{nack}); err != nil {
+			logger.LogError("Error sending NACK", "error", err, "trackId", p.TrackID, "peerId", p.PublisherID)
+		}
+	}
+}
+
+// parseFrame reads the layers of a VP9 or AV1 packet, nil for other codecs or packets without layer ids
+func (p *Publication) parseFrame(pkt *rtp.Packet) *frameInfo {
+	var frame frameInfo
+	switch {
+	case strings.EqualFold(p.Codec.MimeType, webrtc.MimeTypeVP9):
+		var ok bool
+		if frame, ok = parseVP9(pkt.Payload); !ok {
+			return nil
+		}
+	case strings.EqualFold(p.Codec.MimeType, webrtc.MimeTypeAV1):
+		id := p.dependencyID.Load()
+		if id == 0 {
+			return nil
+		}
+		descriptor := pkt.GetExtension(uint8(id))
+		if descriptor == nil {
+			return nil
+		}
+		var structure *dependencyStructure
+		var err error
+		if frame, structure, err = parseDependencyDescriptor(descriptor, p.dependencies.Load()); structure != nil {
+			p.dependencies.Store(structure)
+		}
+		if err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if !frame.layered {
+		return nil
+	}
+	return &frame
+}
+
+// highestLayers is the highest layers seen including the frame, the caller holds lock
+func (p *Publication) highestLayers(frame *frameInfo) svcLayer {
+	return svcLayer{
+		spatial:  min(max(p.svcLayers.spatial, frame.layer.spatial, frame.layers.spatial), maxSpatialLayers-1),
+		temporal: min(max(p.svcLayers.temporal, frame.layer.temporal, frame.layers.temporal), maxTemporalLayers-1),
+	}
+}
+
+// addSVCLayers extends the ladder to the layers the frame shows and moves the subscribers up it
+func (p *Publication) addSVCLayers(frame *frameInfo) {
+	p.lock.Lock()
+	p.svcLayers = p.highestLayers(frame)
+	retargeted := p.retarget()
+	p.lock.Unlock()
+
+	p.requestKeyframes(retargeted)
+}
@@ -0,0 +1,38 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestResumeSkipsPausedPackets(t *testing.T) {
+	p := newTestPublication(webrtc.MimeTypeVP8)
+	var nacks int
+	p.writeRTCP = func(packets []rtcp.Packet) error {
+		for _, packet := range packets {
+			if _, ok := packet.(*rtcp.TransportLayerNack); ok {
+				nacks++
+			}
+		}
+		return nil
+	}
+	d, err := p.Subscribe("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyframe := []byte{0x10, 0x00, 0x9d, 0x01, 0x2a} // VP8 start of partition, keyframe bit clear
+	p.Forward("", &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, SequenceNumber: 100}, Payload: keyframe})
+	p.Resume()
+	// Packets 101 to 119 were left out while the video was off
+	p.Forward("", &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, SequenceNumber: 120}, Payload: []byte{0x10, 0x01}})
+	if nacks != 0 {
+		t.Errorf("%d NACKs for packets skipped during the pause", nacks)
+	}
+	if current, _ := d.Layer(); current != "" || !d.waiting {
+		t.Error("subscriber not waiting for a keyframe after the pause")
+	}
+}
@@ -0,0 +1,130 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// A sequence number this far from the highest one seen means the publisher restarted its stream
+// rather than lost or reordered packets
+const maxSequenceJump = 1000
+
+// Dropped sequence numbers remembered to number late packets, a packet arriving later than this
+// many drops after it was sent can't be numbered and is dropped as well
+const dropHistory = 256
+
+// Rewriter maps the packets of a changing source onto one continuous stream of sequence numbers and
+// timestamps. The source changes on layer switches, SSRC changes and publisher restarts, each new
+// source continues right after the last packet sent with the clock advanced by the time that passed.
+type Rewriter struct {
+	clockRate uint32
+
+	started  bool
+	resync   bool // The next packet starts a new source
+	ssrc     uint32
+	previous uint32 // SSRC of the source before, its late packets are dropped
+
+	// Incoming sequence numbers of the current source: packets from before the first one belong
+	// to an earlier source and are dropped, the highest one detects jumps and reordering
+	firstSeq   uint16
+	highestSeq uint16
+
+	seqOffset uint16
+	tsOffset  uint32
+
+	// Incoming sequence numbers of the current source that were dropped, oldest first in a ring.
+	// Each one lowered seqOffset, a late packet sent before some of them gets that back.
+	drops     [dropHistory]uint16
+	dropCount int
+
+	// The highest packet sent, what the next source continues from
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+func NewRewriter(clockRate uint32) *Rewriter {
+	return &Rewriter{clockRate: clockRate}
+}
+
+// Resync makes the next packet start a new source, even with an unchanged SSRC
+func (w *Rewriter) Resync() {
+	w.resync = true
+}
+
+// Rewrite returns the sequence number and timestamp a packet gets on the outgoing stream, ok is
+// false when the packet must be dropped
+func (w *Rewriter) Rewrite(header *rtp.Header, now time.Time) (seq uint16, ts uint32, ok bool) {
+	switch {
+	case !w.started:
+		w.started = true
+		w.start(header)
+		w.seqOffset, w.tsOffset = 0, 0
+	case !w.resync && header.SSRC == w.previous && header.SSRC != w.ssrc:
+		return 0, 0, false // Late packet of the previous source
+	case w.resync || header.SSRC != w.ssrc || w.jumped(header.SequenceNumber):
+		ticks := uint32(now.Sub(w.lastWrite).Seconds() * float64(w.clockRate))
+		w.start(header)
+		w.seqOffset = w.lastSeq + 1 - header.SequenceNumber
+		w.tsOffset = w.lastTS + max(ticks, 1) - header.Timestamp
+	case int16(header.SequenceNumber-w.firstSeq) < 0:
+		return 0, 0, false // Sent before the restart, its number is taken
+	}
+
+	seq = header.SequenceNumber + w.seqOffset
+	ts = header.Timestamp + w.tsOffset
+	if int16(header.SequenceNumber-w.highestSeq) > 0 {
+		// In order: this is what the next source continues from
+		w.highestSeq = header.SequenceNumber
+		w.lastSeq, w.lastTS, w.lastWrite = seq, ts, now
+		return seq, ts, true
+	}
+	// Reordered packets keep the number they would have had in order
+	later, known := w.dropsAfter(header.SequenceNumber)
+	if !known {
+		return 0, 0, false
+	}
+	return seq + uint16(later), ts, true
+}
+
+// Drop skips a packet the subscriber doesn't get, the packets after it close the gap. A late
+// packet dropped after a later one was sent leaves its number unused.
+func (w *Rewriter) Drop(header *rtp.Header) {
+	if !w.started || w.resync || header.SSRC != w.ssrc || w.jumped(header.SequenceNumber) {
+		return // The next packet sent starts a new source anyway
+	}
+	if int16(header.SequenceNumber-w.highestSeq) > 0 {
+		w.highestSeq = header.SequenceNumber
+		w.seqOffset--
+		w.drops[w.dropCount%dropHistory] = header.SequenceNumber
+		w.dropCount++
+	}
+}
+
+// dropsAfter counts the drops of packets sent after seq, known is false when some of them are no
+// longer remembered
+func (w *Rewriter) dropsAfter(seq uint16) (later int, known bool) {
+	kept := min(w.dropCount, dropHistory)
+	for later < kept && int16(w.drops[(w.dropCount-later-1)%dropHistory]-seq) > 0 {
+		later++
+	}
+	return later, later < kept || w.dropCount <= dropHistory
+}
+
+// start makes the packet the first one of a new source
+func (w *Rewriter) start(header *rtp.Header) {
+	w.resync = false
+	if header.SSRC != w.ssrc {
+		w.previous = w.ssrc
+	}
+	w.ssrc = header.SSRC
+	w.firstSeq = header.SequenceNumber
+	w.highestSeq = header.SequenceNumber - 1
+	w.dropCount = 0
+}
+
+func (w *Rewriter) jumped(seq uint16) bool {
+	delta := int(int16(seq - w.highestSeq))
+	return delta > maxSequenceJump || delta < -maxSequenceJump
+}
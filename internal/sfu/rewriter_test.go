@@ -0,0 +1,211 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rewriteStep is one packet fed to a Rewriter clocked at 90 kHz (90 ticks per millisecond) and
+// what should come out of it
+type rewriteStep struct {
+	resync bool // Resync before the packet
+	drop   bool // Dropped rather than rewritten
+	ssrc   uint32
+	seq    uint16
+	ts     uint32
+	at     time.Duration // Since the first packet
+
+	ok      bool
+	wantSeq uint16
+	wantTS  uint32
+}
+
+func TestRewriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []rewriteStep
+	}{
+		{
+			name: "first source keeps its numbers",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{ssrc: 1, seq: 101, ts: 4000, at: 33 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 4000},
+			},
+		},
+		{
+			name: "ssrc change continues the stream",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{ssrc: 1, seq: 101, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 4000},
+				{ssrc: 2, seq: 5000, ts: 900000, at: 20 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 4900},
+				{ssrc: 2, seq: 5001, ts: 903000, at: 30 * time.Millisecond, ok: true, wantSeq: 103, wantTS: 7900},
+			},
+		},
+		{
+			name: "layer switch with resync",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{resync: true, ssrc: 2, seq: 40, ts: 50000, at: 20 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 2800},
+				{ssrc: 2, seq: 41, ts: 53000, at: 30 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 5800},
+			},
+		},
+		{
+			name: "publisher restart keeping its ssrc",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{resync: true, ssrc: 1, seq: 200, ts: 50000, at: 20 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 2800},
+				{ssrc: 1, seq: 199, ts: 47000, at: 25 * time.Millisecond}, // Sent before the restart
+				{ssrc: 1, seq: 201, ts: 53000, at: 30 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 5800},
+			},
+		},
+		{
+			name: "sequence jump starts a new source",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{ssrc: 1, seq: 101, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 4000},
+				{ssrc: 1, seq: 30000, ts: 777, at: 40 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 6700},
+				{ssrc: 1, seq: 30001, ts: 3777, at: 50 * time.Millisecond, ok: true, wantSeq: 103, wantTS: 9700},
+			},
+		},
+		{
+			name: "late packets of the previous ssrc are dropped",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{ssrc: 2, seq: 500, ts: 8000, at: 10 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 1900},
+				{ssrc: 1, seq: 101, ts: 4000, at: 15 * time.Millisecond},
+				{ssrc: 2, seq: 501, ts: 11000, at: 20 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 4900},
+			},
+		},
+		{
+			name: "sequence wraparound",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 65534, ts: 1000, ok: true, wantSeq: 65534, wantTS: 1000},
+				{ssrc: 1, seq: 65535, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 65535, wantTS: 4000},
+				{ssrc: 1, seq: 0, ts: 7000, at: 20 * time.Millisecond, ok: true, wantSeq: 0, wantTS: 7000},
+				{ssrc: 2, seq: 10, ts: 5, at: 30 * time.Millisecond, ok: true, wantSeq: 1, wantTS: 7900},
+				{ssrc: 2, seq: 11, ts: 3005, at: 40 * time.Millisecond, ok: true, wantSeq: 2, wantTS: 10900},
+			},
+		},
+		{
+			name: "offset wraps the outgoing sequence number",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 65535, ts: 1000, ok: true, wantSeq: 65535, wantTS: 1000},
+				{ssrc: 2, seq: 10, ts: 5, at: 10 * time.Millisecond, ok: true, wantSeq: 0, wantTS: 1900},
+				{ssrc: 2, seq: 11, ts: 3005, at: 20 * time.Millisecond, ok: true, wantSeq: 1, wantTS: 4900},
+			},
+		},
+		{
+			name: "timestamp wraparound",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 4294967000, ok: true, wantSeq: 100, wantTS: 4294967000},
+				{ssrc: 1, seq: 101, ts: 200, at: 33 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 200},
+				{ssrc: 2, seq: 7, ts: 123456, at: 133 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 9200},
+			},
+		},
+		{
+			name: "offset wraps the outgoing timestamp",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 4294967000, ok: true, wantSeq: 100, wantTS: 4294967000},
+				{ssrc: 2, seq: 7, ts: 123456, at: 100 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 8704},
+			},
+		},
+		{
+			name: "reordered packets keep their number",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 100, ts: 1000, ok: true, wantSeq: 100, wantTS: 1000},
+				{ssrc: 1, seq: 102, ts: 7000, at: 20 * time.Millisecond, ok: true, wantSeq: 102, wantTS: 7000},
+				{ssrc: 1, seq: 101, ts: 4000, at: 25 * time.Millisecond, ok: true, wantSeq: 101, wantTS: 4000},
+				// The next source continues from the highest packet, not the reordered one
+				{ssrc: 2, seq: 50, ts: 0, at: 30 * time.Millisecond, ok: true, wantSeq: 103, wantTS: 7900},
+			},
+		},
+		{
+			name: "dropped packets leave no gap",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 10, ts: 1000, ok: true, wantSeq: 10, wantTS: 1000},
+				{ssrc: 1, seq: 11, ts: 1000, drop: true},
+				{ssrc: 1, seq: 12, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 11, wantTS: 4000},
+				{ssrc: 1, seq: 13, ts: 7000, drop: true},
+				{ssrc: 1, seq: 14, ts: 7000, drop: true},
+				{ssrc: 1, seq: 15, ts: 10000, at: 20 * time.Millisecond, ok: true, wantSeq: 12, wantTS: 10000},
+			},
+		},
+		{
+			name: "late packet sent before a drop keeps its number",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 10, ts: 1000, ok: true, wantSeq: 10, wantTS: 1000},
+				{ssrc: 1, seq: 12, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 12, wantTS: 4000},
+				{ssrc: 1, seq: 13, ts: 7000, drop: true},
+				{ssrc: 1, seq: 11, ts: 1000, at: 15 * time.Millisecond, ok: true, wantSeq: 11, wantTS: 1000},
+				{ssrc: 1, seq: 14, ts: 10000, at: 20 * time.Millisecond, ok: true, wantSeq: 13, wantTS: 10000},
+			},
+		},
+		{
+			name: "late packet between drops",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 10, ts: 1000, ok: true, wantSeq: 10, wantTS: 1000},
+				{ssrc: 1, seq: 11, ts: 1000, drop: true},
+				{ssrc: 1, seq: 13, ts: 4000, at: 10 * time.Millisecond, ok: true, wantSeq: 12, wantTS: 4000},
+				{ssrc: 1, seq: 14, ts: 4000, drop: true},
+				{ssrc: 1, seq: 12, ts: 1000, at: 15 * time.Millisecond, ok: true, wantSeq: 11, wantTS: 1000},
+				{ssrc: 1, seq: 15, ts: 7000, at: 20 * time.Millisecond, ok: true, wantSeq: 13, wantTS: 7000},
+			},
+		},
+		{
+			name: "drops before a new source don't count",
+			steps: []rewriteStep{
+				{ssrc: 1, seq: 10, ts: 1000, ok: true, wantSeq: 10, wantTS: 1000},
+				{ssrc: 1, seq: 11, ts: 1000, drop: true},
+				{ssrc: 2, seq: 500, ts: 0, at: 10 * time.Millisecond, ok: true, wantSeq: 11, wantTS: 1900},
+				{ssrc: 2, seq: 502, ts: 6000, at: 20 * time.Millisecond, ok: true, wantSeq: 13, wantTS: 7900},
+				{ssrc: 2, seq: 501, ts: 3000, at: 25 * time.Millisecond, ok: true, wantSeq: 12, wantTS: 4900},
+			},
+		},
+	}
+
+	start := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewRewriter(90000)
+			for i, step := range tt.steps {
+				if step.resync {
+					w.Resync()
+				}
+				header := &rtp.Header{SSRC: step.ssrc, SequenceNumber: step.seq, Timestamp: step.ts}
+				if step.drop {
+					w.Drop(header)
+					continue
+				}
+				seq, ts, ok := w.Rewrite(header, start.Add(step.at))
+				if ok != step.ok {
+					t.Fatalf("step %d: ok = %v, want %v", i, ok, step.ok)
+				}
+				if ok && (seq != step.wantSeq || ts != step.wantTS) {
+					t.Fatalf("step %d: got seq %d ts %d, want seq %d ts %d", i, seq, ts, step.wantSeq, step.wantTS)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriterForgetsOldDrops(t *testing.T) {
+	w := NewRewriter(90000)
+	now := time.Now()
+	if _, _, ok := w.Rewrite(&rtp.Header{SSRC: 1, SequenceNumber: 0}, now); !ok {
+		t.Fatal("first packet dropped")
+	}
+	for seq := uint16(2); seq < dropHistory+3; seq++ {
+		w.Drop(&rtp.Header{SSRC: 1, SequenceNumber: seq})
+	}
+	// Sent before more drops than are remembered: its number can't be told, better lost than a duplicate
+	if _, _, ok := w.Rewrite(&rtp.Header{SSRC: 1, SequenceNumber: 1}, now); ok {
+		t.Fatal("late packet older than the drop history was forwarded")
+	}
+	// The late packet's number stays unused
+	seq, _, ok := w.Rewrite(&rtp.Header{SSRC: 1, SequenceNumber: dropHistory + 3}, now)
+	if !ok || seq != 2 {
+		t.Fatalf("got seq %d ok %v after the drops, want 2", seq, ok)
+	}
+}
@@ -0,0 +1,57 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// ReceiverStats is what a subscriber last reported about receiving a down track
+type ReceiverStats struct {
+	FractionLost float64 // Share of the packets lost since the previous report
+	PacketsLost  uint32  // Since the subscriber started receiving
+	Jitter       time.Duration
+	RTT          time.Duration // 0 until a report refers to one of our sender reports
+	UpdatedAt    time.Time     // Zero before the first report
+}
+
+// ntpEpoch is where NTP time starts, sender reports carry NTP timestamps
+var ntpEpoch = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ntpCompact is the middle 32 bits of the NTP timestamp (16.16 fixed point seconds), the unit of
+// the LSR and DLSR fields of reception reports
+func ntpCompact(t time.Time) uint32 {
+	elapsed := t.Sub(ntpEpoch)
+	seconds := uint64(elapsed / time.Second)
+	fraction := uint64(elapsed%time.Second) << 16 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction)
+}
+
+// UpdateStats records a reception report the subscriber sent about this down track
+func (d *DownTrack) UpdateStats(report rtcp.ReceptionReport, now time.Time) {
+	stats := ReceiverStats{
+		FractionLost: float64(report.FractionLost) / 256,
+		PacketsLost:  report.TotalLost,
+		UpdatedAt:    now,
+	}
+	if clockRate := d.pub.Codec.ClockRate; clockRate > 0 {
+		stats.Jitter = time.Duration(report.Jitter) * time.Second / time.Duration(clockRate)
+	}
+	if report.LastSenderReport != 0 {
+		// Arrival minus when our report was sent minus how long the subscriber held on to it
+		if rtt := ntpCompact(now) - report.LastSenderReport - report.Delay; int32(rtt) > 0 {
+			stats.RTT = time.Duration(rtt) * time.Second >> 16
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stats = stats
+}
+
+// Stats returns what the subscriber last reported
+func (d *DownTrack) Stats() ReceiverStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.stats
+}
@@ -0,0 +1,211 @@
+package sfu
+
+import (
+	"fmt"
+)
+
+// Layer ids past these are always dropped, browsers send at most 3 spatial and 3 temporal layers
+const (
+	maxSpatialLayers  = 4
+	maxTemporalLayers = 4
+)
+
+// svcLayer is a spatial (resolution) and temporal (frame rate) layer of a scalable VP9 or AV1 stream
+type svcLayer struct {
+	spatial  int
+	temporal int
+}
+
+func (l svcLayer) String() string {
+	return fmt.Sprintf("S%dT%d", l.spatial, l.temporal)
+}
+
+// frameInfo is what the forwarder needs to know about a packet of a scalable stream, read from the
+// VP9 payload descriptor or the AV1 dependency descriptor
+type frameInfo struct {
+	layer      svcLayer
+	layered    bool     // The packet carries layer ids, without them it can't be dropped selectively
+	layers     svcLayer // Highest layers the publisher announces, zero when the packet doesn't say
+	beginFrame bool     // First packet of the layer frame
+	endFrame   bool     // Last packet of the layer frame
+	switchUp   bool     // Frames of higher temporal layers can be decoded from this one on
+
+	pictureID   int // VP9 picture id the SFU may renumber, -1 when there is none or it can't be changed
+	pictureBits int // 7 or 15
+}
+
+// layout is how a publication's quality steps up: from one simulcast layer to the next, or for a
+// single scalable layer along its spatial and temporal layers
+type layout struct {
+	rids []string   // Lowest to highest quality
+	svc  []svcLayer // nil unless the single layer is scalable
+}
+
+func (l layout) steps() int {
+	if l.svc != nil {
+		return len(l.svc)
+	}
+	return len(l.rids)
+}
+
+// svcLadder lists the quality steps up to the highest layers: the frame rate goes up at the lowest
+// resolution first, then the resolution at the full frame rate
+func svcLadder(highest svcLayer) []svcLayer {
+	var ladder []svcLayer
+	for t := 0; t <= highest.temporal; t++ {
+		ladder = append(ladder, svcLayer{temporal: t})
+	}
+	for s := 1; s <= highest.spatial; s++ {
+		ladder = append(ladder, svcLayer{spatial: s, temporal: highest.temporal})
+	}
+	return ladder
+}
+
+// svcQualityIndex maps a quality onto a ladder: low is the lowest resolution at the full frame
+// rate, high the best step, mid the resolution in between
+func svcQualityIndex(ladder []svcLayer, q Quality) int {
+	highest := ladder[len(ladder)-1]
+	switch q {
+	case QualityLow:
+		return highest.temporal
+	case QualityMid:
+		return highest.temporal + (highest.spatial+1)/2
+	}
+	return len(ladder) - 1
+}
+
+// parseVP9 reads the VP9 payload descriptor, see RFC 9628 section 4.2
+func parseVP9(payload []byte) (frameInfo, bool) {
+	frame := frameInfo{pictureID: -1}
+	if len(payload) == 0 {
+		return frame, false
+	}
+	hasPictureID := payload[0]&0x80 != 0
+	interPicture := payload[0]&0x40 != 0
+	frame.layered = payload[0]&0x20 != 0
+	flexible := payload[0]&0x10 != 0
+	frame.beginFrame = payload[0]&0x08 != 0
+	frame.endFrame = payload[0]&0x04 != 0
+	hasScalability := payload[0]&0x02 != 0
+
+	pos := 1
+	if hasPictureID {
+		if len(payload) < pos+1 {
+			return frame, false
+		}
+		id, bits := int(payload[pos]&0x7f), 7
+		if payload[pos]&0x80 != 0 {
+			if len(payload) < pos+2 {
+				return frame, false
+			}
+			id, bits = id<<8|int(payload[pos+1]), 15
+		}
+		pos += bits/8 + 1
+		if !flexible {
+			// In flexible mode frames name their references by picture id differences, so the ids stay
+			frame.pictureID, frame.pictureBits = id, bits
+		}
+	}
+	if frame.layered {
+		if len(payload) < pos+1 {
+			return frame, false
+		}
+		frame.layer = svcLayer{spatial: int(payload[pos] >> 1 & 0x07), temporal: int(payload[pos] >> 5)}
+		frame.switchUp = payload[pos]&0x10 != 0
+		pos++
+		if !flexible {
+			pos++ // TL0PICIDX
+		}
+	}
+	if flexible && interPicture {
+		for range 3 { // Reference indices, the N bit says whether another one follows
+			if len(payload) < pos+1 {
+				return frame, false
+			}
+			pos++
+			if payload[pos-1]&0x01 == 0 {
+				break
+			}
+		}
+	}
+	if hasScalability {
+		if len(payload) < pos+1 {
+			return frame, false
+		}
+		frame.layers.spatial = int(payload[pos] >> 5) // N_S is the number of spatial layers minus one
+	}
+	return frame, true
+}
+
+// setVP9PictureID writes a picture id of the same length over the one in the payload descriptor
+func setVP9PictureID(payload []byte, id, bits int) {
+	if bits == 15 {
+		payload[1] = 0x80 | byte(id>>8&0x7f)
+		payload[2] = byte(id)
+		return
+	}
+	payload[1] = byte(id & 0x7f)
+}
+
+// Pictures whose outgoing VP9 picture id is remembered for their late packets
+const pictureHistory = 16
+
+// svcFilter decides which layers of a scalable stream one subscriber gets
+type svcFilter struct {
+	enabled bool     // The publication is a single scalable layer
+	target  svcLayer // Highest layers the subscriber should get
+	current svcLayer // Highest layers being forwarded
+
+	// VP9 picture ids are renumbered so pictures left out don't look like losses. The latest
+	// pictures forwarded are kept in a ring, incoming id and the id it went out with.
+	pictures     [pictureHistory]struct{ in, out int }
+	pictureCount int
+}
+
+// setTarget reports whether getting to the new target takes a keyframe, which spatial up-switches do
+func (f *svcFilter) setTarget(layer svcLayer) bool {
+	changed := layer != f.target
+	f.target = layer
+	return changed && layer.spatial > f.current.spatial
+}
+
+// admit reports whether the packet is forwarded. Layers only change where a picture starts: down
+// at once, the frame rate up at a temporal switching point, the resolution up on a keyframe.
+func (f *svcFilter) admit(frame *frameInfo, isKeyframe func() bool) bool {
+	if frame.beginFrame && frame.layer.spatial == 0 {
+		if f.target.spatial < f.current.spatial || (f.target.spatial > f.current.spatial && isKeyframe()) {
+			f.current.spatial = f.target.spatial
+		}
+		if f.target.temporal < f.current.temporal || (f.target.temporal > f.current.temporal && (frame.layer.temporal == 0 || frame.switchUp)) {
+			f.current.temporal = f.target.temporal
+		}
+	}
+	return frame.layer.spatial <= f.current.spatial && frame.layer.temporal <= f.current.temporal
+}
+
+// renumber maps a forwarded packet's picture id onto the outgoing sequence of ids, ok is false for
+// a late packet of a picture no longer remembered
+func (f *svcFilter) renumber(id, bits int) (out int, ok bool) {
+	mask := 1<<bits - 1
+	if f.pictureCount == 0 {
+		return f.record(id, id), true
+	}
+	last := f.pictures[(f.pictureCount-1)%pictureHistory]
+	if delta := (id - last.in) & mask; delta == 0 {
+		return last.out & mask, true
+	} else if delta <= mask/2 {
+		return f.record(id, (last.out+1)&mask), true
+	}
+	for i := 2; i <= min(f.pictureCount, pictureHistory); i++ { // A late packet of an earlier picture
+		if picture := f.pictures[(f.pictureCount-i)%pictureHistory]; picture.in == id {
+			return picture.out & mask, true
+		}
+	}
+	return 0, false
+}
+
+func (f *svcFilter) record(in, out int) int {
+	f.pictures[f.pictureCount%pictureHistory] = struct{ in, out int }{in, out}
+	f.pictureCount++
+	return out
+}
@@ -0,0 +1,417 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// VP9 payload descriptors (RFC 9628) followed by the first bytes of the frame, as browsers send them
+var (
+	// Keyframe, spatial layer 0, first packet: non-flexible, picture id 0x1234 (15 bits), TL0PICIDX 5
+	// and the scalability structure for 3 spatial layers (160x90, 320x180, 640x360), no GOF
+	vp9KeyS0 = "aa923400055800a0005a014000b4028001680082490b"
+	// The same picture's spatial layer 1, last packet, depending on layer 0
+	vp9KeyS1End = "ac923403058249"
+	// Delta frame, spatial layer 0, temporal layer 2 switching up point, picture id 0x35 (7 bits)
+	vp9DeltaT2 = "ec355005861a"
+	// Flexible mode delta frame, spatial layer 2, temporal layer 1, two reference indices
+	vp9Flexible = "f892352503048600"
+)
+
+func TestParseVP9(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+		want frameInfo
+	}{
+		{
+			name: "keyframe with scalability structure",
+			data: vp9KeyS0,
+			ok:   true,
+			want: frameInfo{layered: true, layers: svcLayer{spatial: 2}, beginFrame: true, pictureID: 0x1234, pictureBits: 15},
+		},
+		{
+			name: "upper spatial layer",
+			data: vp9KeyS1End,
+			ok:   true,
+			want: frameInfo{layer: svcLayer{spatial: 1}, layered: true, beginFrame: true, endFrame: true, pictureID: 0x1234, pictureBits: 15},
+		},
+		{
+			name: "temporal switching up point",
+			data: vp9DeltaT2,
+			ok:   true,
+			want: frameInfo{layer: svcLayer{temporal: 2}, layered: true, beginFrame: true, endFrame: true, switchUp: true, pictureID: 0x35, pictureBits: 7},
+		},
+		{
+			name: "flexible mode keeps picture ids",
+			data: vp9Flexible,
+			ok:   true,
+			want: frameInfo{layer: svcLayer{spatial: 2, temporal: 1}, layered: true, beginFrame: true, pictureID: -1},
+		},
+		{name: "empty", data: "", want: frameInfo{pictureID: -1}},
+		{name: "missing picture id", data: "80", want: frameInfo{pictureID: -1}},
+		{name: "truncated long picture id", data: "8092", want: frameInfo{pictureID: -1}},
+		{name: "missing layer indices", data: "a092", want: frameInfo{layered: true, pictureID: 0x12, pictureBits: 7}},
+		{name: "truncated reference indices", data: "f89235250301", want: frameInfo{layer: svcLayer{spatial: 2, temporal: 1}, layered: true, beginFrame: true, pictureID: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, ok := parseVP9(fixture(t, tt.data))
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && frame != tt.want {
+				t.Fatalf("got %+v, want %+v", frame, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetVP9PictureID(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		id   int
+		bits int
+	}{
+		{vp9KeyS0, 0x7ffe, 15},
+		{vp9DeltaT2, 0x01, 7},
+	} {
+		payload := fixture(t, tt.data)
+		setVP9PictureID(payload, tt.id, tt.bits)
+		frame, ok := parseVP9(payload)
+		if !ok || frame.pictureID != tt.id || frame.pictureBits != tt.bits {
+			t.Errorf("%s: got picture id %d (%d bits), want %d (%d bits)", tt.data, frame.pictureID, frame.pictureBits, tt.id, tt.bits)
+		}
+	}
+}
+
+func TestSVCLadder(t *testing.T) {
+	tests := []struct {
+		highest        svcLayer
+		steps          int
+		low, mid, high svcLayer
+	}{
+		{svcLayer{spatial: 2, temporal: 2}, 5, svcLayer{0, 2}, svcLayer{1, 2}, svcLayer{2, 2}},
+		{svcLayer{spatial: 1, temporal: 2}, 4, svcLayer{0, 2}, svcLayer{1, 2}, svcLayer{1, 2}},
+		{svcLayer{temporal: 2}, 3, svcLayer{0, 2}, svcLayer{0, 2}, svcLayer{0, 2}},
+		{svcLayer{spatial: 2}, 3, svcLayer{0, 0}, svcLayer{1, 0}, svcLayer{2, 0}},
+	}
+	for _, tt := range tests {
+		ladder := svcLadder(tt.highest)
+		if len(ladder) != tt.steps {
+			t.Errorf("%v: %d steps, want %d", tt.highest, len(ladder), tt.steps)
+			continue
+		}
+		for q, want := range map[Quality]svcLayer{QualityLow: tt.low, QualityMid: tt.mid, QualityHigh: tt.high} {
+			if got := ladder[svcQualityIndex(ladder, q)]; got != want {
+				t.Errorf("%v %v: got %v, want %v", tt.highest, q, got, want)
+			}
+		}
+	}
+}
+
+func TestSVCFilter(t *testing.T) {
+	type step struct {
+		target   *svcLayer // Set before the packet
+		layer    svcLayer
+		begin    bool
+		switchUp bool
+		keyframe bool
+
+		admit   bool
+		current svcLayer
+	}
+	tests := []struct {
+		name  string
+		start svcLayer
+		steps []step
+	}{
+		{
+			name:  "down switches wait for the next picture",
+			start: svcLayer{spatial: 2, temporal: 2},
+			steps: []step{
+				{target: &svcLayer{spatial: 0, temporal: 1}, layer: svcLayer{spatial: 1, temporal: 2}, admit: true, current: svcLayer{2, 2}},
+				{layer: svcLayer{temporal: 2}, begin: true, current: svcLayer{0, 1}},
+				{layer: svcLayer{spatial: 1, temporal: 2}, begin: true, current: svcLayer{0, 1}},
+				{layer: svcLayer{temporal: 1}, begin: true, admit: true, current: svcLayer{0, 1}},
+				{layer: svcLayer{spatial: 1, temporal: 1}, begin: true, current: svcLayer{0, 1}},
+			},
+		},
+		{
+			name:  "frame rate goes up at temporal layer 0 or a switching point",
+			start: svcLayer{},
+			steps: []step{
+				{target: &svcLayer{temporal: 2}, layer: svcLayer{temporal: 2}, begin: true, current: svcLayer{}},
+				{layer: svcLayer{temporal: 1}, begin: true, switchUp: true, admit: true, current: svcLayer{0, 2}},
+				{layer: svcLayer{temporal: 2}, begin: true, admit: true, current: svcLayer{0, 2}},
+			},
+		},
+		{
+			name:  "resolution goes up on a keyframe only",
+			start: svcLayer{temporal: 2},
+			steps: []step{
+				{target: &svcLayer{spatial: 2, temporal: 2}, layer: svcLayer{}, begin: true, admit: true, current: svcLayer{0, 2}},
+				{layer: svcLayer{spatial: 1}, begin: true, current: svcLayer{0, 2}},
+				{layer: svcLayer{}, begin: true, keyframe: true, admit: true, current: svcLayer{2, 2}},
+				{layer: svcLayer{spatial: 1}, begin: true, admit: true, current: svcLayer{2, 2}},
+				{layer: svcLayer{spatial: 2}, begin: true, admit: true, current: svcLayer{2, 2}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := svcFilter{enabled: true, target: tt.start, current: tt.start}
+			for i, s := range tt.steps {
+				if s.target != nil {
+					f.setTarget(*s.target)
+				}
+				frame := &frameInfo{layer: s.layer, layered: true, beginFrame: s.begin, switchUp: s.switchUp}
+				if admit := f.admit(frame, func() bool { return s.keyframe }); admit != s.admit || f.current != s.current {
+					t.Fatalf("step %d: admit %v with %v, want %v with %v", i, admit, f.current, s.admit, s.current)
+				}
+			}
+		})
+	}
+}
+
+func TestSVCFilterSetTarget(t *testing.T) {
+	f := svcFilter{enabled: true, current: svcLayer{spatial: 1, temporal: 2}}
+	if f.setTarget(svcLayer{spatial: 1, temporal: 0}) {
+		t.Error("a temporal change asked for a keyframe")
+	}
+	if !f.setTarget(svcLayer{spatial: 2, temporal: 2}) {
+		t.Error("a spatial up-switch didn't ask for a keyframe")
+	}
+	if f.setTarget(svcLayer{spatial: 2, temporal: 2}) {
+		t.Error("an unchanged target asked for a keyframe again")
+	}
+}
+
+func TestSVCFilterRenumber(t *testing.T) {
+	f := svcFilter{}
+	steps := []struct {
+		in, bits, want int
+		ok             bool
+	}{
+		{0x7d, 7, 0x7d, true},
+		{0x7e, 7, 0x7e, true},
+		{0x7e, 7, 0x7e, true}, // Another packet of the same picture
+		{0x01, 7, 0x7f, true}, // Pictures 0x7f and 0x00 were dropped
+		{0x7e, 7, 0x7e, true}, // Late packet of an earlier picture
+		{0x7d, 7, 0x7d, true},
+		{0x05, 7, 0x00, true}, // Wraps around
+		{0x7c, 7, 0, false},   // Never forwarded
+	}
+	for i, s := range steps {
+		if got, ok := f.renumber(s.in, s.bits); got != s.want || ok != s.ok {
+			t.Fatalf("step %d: picture %#x became %#x %v, want %#x %v", i, s.in, got, ok, s.want, s.ok)
+		}
+	}
+}
+
+func TestSVCFilterRenumberForgets(t *testing.T) {
+	f := svcFilter{}
+	for id := range pictureHistory + 1 {
+		f.renumber(id*2, 15) // Every other picture dropped
+	}
+	if got, ok := f.renumber(2, 15); !ok || got != 1 {
+		t.Errorf("picture 2 became %d %v, want 1", got, ok)
+	}
+	// Older than the pictures remembered: better dropped than given a wrong id
+	if _, ok := f.renumber(0, 15); ok {
+		t.Error("late packet of a forgotten picture renumbered")
+	}
+}
+
+// newTestPublication is a single layer publication without a publisher behind it, keyframe
+// requests are swallowed
+func newTestPublication(mime string) *Publication {
+	return &Publication{
+		Kind:       webrtc.RTPCodecTypeVideo,
+		Codec:      webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mime, ClockRate: 90000}},
+		writeRTCP:  func([]rtcp.Packet) error { return nil },
+		keyframes:  map[string]*keyframeRequest{"": {pending: true}},
+		layers:     map[string]*webrtc.TrackRemote{"": nil},
+		order:      []string{""},
+		downTracks: make(map[string]*DownTrack),
+		rates:      map[string]*layerRate{"": {}},
+		losses:     map[string]*lossTracker{"": newLossTracker()},
+	}
+}
+
+// sent reads what the down track forwarded back from its packet cache, oldest first
+func sent(t *testing.T, d *DownTrack, first uint16, n int) []*rtp.Packet {
+	t.Helper()
+	packets := make([]*rtp.Packet, n)
+	for i := range packets {
+		data := d.cache.Get(first + uint16(i))
+		if data == nil {
+			t.Fatalf("packet %d of %d not forwarded", i, n)
+		}
+		packets[i] = &rtp.Packet{}
+		if err := packets[i].Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.cache.Get(first+uint16(n)) != nil {
+		t.Fatalf("more than %d packets forwarded", n)
+	}
+	return packets
+}
+
+// vp9Picture is one L3T3 picture in non-flexible mode, two packets per spatial layer
+type vp9Picture struct {
+	id       int
+	temporal int
+	keyframe bool
+}
+
+func (p vp9Picture) packets(seq uint16) []*rtp.Packet {
+	var packets []*rtp.Packet
+	for s := 0; s < 3; s++ {
+		for part := 0; part < 2; part++ {
+			descriptor := byte(0xa0) // Picture id and layer indices
+			if !p.keyframe {
+				descriptor |= 0x40
+			}
+			if part == 0 {
+				descriptor |= 0x08
+			}
+			if part == 1 {
+				descriptor |= 0x04
+			}
+			layer := byte(p.temporal<<5 | s<<1)
+			if p.temporal > 0 {
+				layer |= 0x10 // Switching up point, as the frames only refer to lower temporal layers
+			}
+			payload := []byte{descriptor, 0x80 | byte(p.id>>8), byte(p.id), layer, 0}
+			if p.keyframe && s == 0 && part == 0 {
+				payload[0] |= 0x02
+				payload = append(payload, 0x40) // N_S = 2, no resolutions
+			}
+			packets = append(packets, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					SSRC:           1,
+					SequenceNumber: seq + uint16(len(packets)),
+					Timestamp:      uint32(p.id) * 3000,
+					Marker:         s == 2 && part == 1,
+				},
+				Payload: append(payload, 0xaa),
+			})
+		}
+	}
+	return packets
+}
+
+func TestForwardVP9Layers(t *testing.T) {
+	p := newTestPublication(webrtc.MimeTypeVP9)
+	d, err := p.Subscribe("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq, id := uint16(65530), 0x7ffe
+	forward := func(keyframe bool, temporal ...int) {
+		for _, tid := range temporal {
+			for _, packet := range (vp9Picture{id: id & 0x7fff, temporal: tid, keyframe: keyframe}).packets(seq) {
+				p.Forward("", packet)
+				seq++
+			}
+			id++
+		}
+	}
+
+	forward(true, 0)
+	if layers := p.Layers(); len(layers.svc) != 3 {
+		t.Fatalf("ladder %v from the scalability structure, want 3 steps", layers.svc)
+	}
+	forward(false, 2, 1, 2)
+	if layers := p.Layers(); len(layers.svc) != 5 {
+		// The structure only has the spatial layers, temporal ones are learnt as they come
+		t.Fatalf("ladder %v after the temporal layers, want 5 steps", layers.svc)
+	}
+	d.SetAllocation(1) // S0T1: the lowest resolution at half the frame rate
+	forward(false, 0, 2, 1, 2)
+
+	packets := sent(t, d, 65530, 6*4+2*2) // Layer 0 of the T0 and T1 pictures after the allocation
+	lastPicture := -1
+	for i, packet := range packets {
+		frame, ok := parseVP9(packet.Payload)
+		if !ok {
+			t.Fatalf("packet %d: unreadable descriptor", i)
+		}
+		if i < 24 {
+			// Everything until the allocation dropped the upper layers
+			if packet.Marker != (frame.layer.spatial == 2 && frame.endFrame) {
+				t.Errorf("packet %d: marker %v on %v", i, packet.Marker, frame.layer)
+			}
+		} else {
+			if frame.layer.spatial != 0 || frame.layer.temporal > 1 {
+				t.Errorf("packet %d: layer %v forwarded over an S0T1 allocation", i, frame.layer)
+			}
+			if packet.Marker != frame.endFrame {
+				t.Errorf("packet %d: marker %v, want it on the last packet of layer 0", i, packet.Marker)
+			}
+		}
+		// Picture ids go up by one per picture, across dropped pictures and the 15 bit wraparound
+		if frame.pictureID != lastPicture && frame.pictureID != (lastPicture+1)&0x7fff && lastPicture >= 0 {
+			t.Errorf("packet %d: picture id %#x after %#x", i, frame.pictureID, lastPicture)
+		}
+		lastPicture = frame.pictureID
+	}
+	if current, target := d.Layer(); current != "S0T1" || target != "S0T1" {
+		t.Errorf("layer %s switching to %s, want S0T1", current, target)
+	}
+}
+
+func TestForwardAV1Layers(t *testing.T) {
+	p := newTestPublication(webrtc.MimeTypeAV1)
+	p.SetDependencyDescriptorID(3)
+	d, err := p.Subscribe("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := uint16(1000)
+	forward := func(descriptor string, payload byte, marker bool) {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SSRC: 1, SequenceNumber: seq, Timestamp: 9000, Marker: marker},
+			Payload: []byte{payload, 0xaa},
+		}
+		if err := packet.SetExtension(3, fixture(t, descriptor)); err != nil {
+			t.Fatal(err)
+		}
+		p.Forward("", packet)
+		seq++
+	}
+
+	// A keyframe starting a coded video sequence (aggregation header N bit) with its structure
+	forward(ddL3T3Key, 0x08, false)
+	d.SetPreferred(QualityMid) // S1T2
+	forward(ddL3T3S1T2, 0x00, false)
+	forward(ddL3T3S2T2, 0x00, true) // Down switches wait for the next picture
+	if current, target := d.Layer(); current != "S2T2" || target != "S1T2" {
+		t.Fatalf("layer %s switching to %s, want S2T2 to S1T2", current, target)
+	}
+	forward(ddL3T3S0T0, 0x00, false)
+	forward(ddL3T3S1T0, 0x00, false)
+	forward(ddL3T3S2T0, 0x00, true) // Dropped, the marker moves to the S1 frame
+
+	packets := sent(t, d, 1000, 5)
+	for i, packet := range packets {
+		if want := i == 2 || i == 4; packet.Marker != want {
+			t.Errorf("packet %d: marker %v, want %v", i, packet.Marker, want)
+		}
+		if packet.SequenceNumber != 1000+uint16(i) {
+			t.Errorf("packet %d: sequence number %d, want %d", i, packet.SequenceNumber, 1000+i)
+		}
+	}
+	if current, _ := d.Layer(); current != "S1T2" {
+		t.Errorf("layer %s, want S1T2", current)
+	}
+}
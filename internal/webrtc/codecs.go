@@ -0,0 +1,85 @@
+package webrtc
+
+import (
+	"fmt"
+	"strings"
+	"video_conferencing_server/internal/config"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var videoFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// videoCodecs holds the payload types registered for each video codec, the same ones pion uses
+// by default, every one followed by its RTX payload type
+var videoCodecs = map[string][]codecEntry{
+	webrtc.MimeTypeVP8: {{96, 97, ""}},
+	webrtc.MimeTypeVP9: {{98, 99, "profile-id=0"}, {100, 101, "profile-id=2"}},
+	webrtc.MimeTypeH264: {
+		{102, 103, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		{104, 105, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"},
+		{106, 107, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{108, 109, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"},
+		{127, 125, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		{39, 40, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"},
+	},
+	webrtc.MimeTypeAV1: {{45, 46, ""}},
+}
+
+var audioCodecs = map[string]webrtc.RTPCodecParameters{
+	webrtc.MimeTypeOpus: {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, PayloadType: 111},
+	webrtc.MimeTypeG722: {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+	webrtc.MimeTypePCMU: {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+	webrtc.MimeTypePCMA: {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+}
+
+type codecEntry struct {
+	payloadType, rtxPayloadType webrtc.PayloadType
+	fmtp                        string
+}
+
+// registerCodecs registers the codecs in preference order, pion offers them in that order
+func registerCodecs(mediaEngine *webrtc.MediaEngine, codecs config.CodecConfig) error {
+	for _, name := range codecs.Video {
+		entries, ok := videoCodecs[canonicalName(name)]
+		if !ok {
+			return fmt.Errorf("unsupported video codec %q", name)
+		}
+		for _, entry := range entries {
+			for _, codec := range []webrtc.RTPCodecParameters{
+				{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: canonicalName(name), ClockRate: 90000, SDPFmtpLine: entry.fmtp, RTCPFeedback: videoFeedback},
+					PayloadType:        entry.payloadType,
+				},
+				{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", entry.payloadType)},
+					PayloadType:        entry.rtxPayloadType,
+				},
+			} {
+				if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, name := range codecs.Audio {
+		codec, ok := audioCodecs[canonicalName(name)]
+		if !ok {
+			return fmt.Errorf("unsupported audio codec %q", name)
+		}
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalName spells a MIME type the way pion does, configurations and SDP may use any case
+func canonicalName(name string) string {
+	for _, known := range append(config.VideoCodecs, config.AudioCodecs...) {
+		if strings.EqualFold(known, name) {
+			return known
+		}
+	}
+	return name
+}
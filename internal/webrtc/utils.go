@@ -1 +1,78 @@
 package webrtc
+
+import (
+	"video_conferencing_server/internal/config"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// DependencyDescriptorURI is the header extension AV1 publishers describe their scalable frames with
+const DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+// NewAPI builds the pion API for a single PeerConnection: the codecs in preference order, the
+// default interceptors (NACKs excepted, see registerInterceptors), the audio level header
+// extension for active speaker detection, the AV1 dependency descriptor so scalable AV1 layers
+// can be dropped and, when enabled, send side congestion control.
+// onEstimator receives the connection's bandwidth estimator once it exists. Every connection gets
+// its own API so the estimator can be tied back to its peer.
+func NewAPI(codecs config.CodecConfig, cfg config.BandwidthConfig, onEstimator func(cc.BandwidthEstimator)) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, codecs); err != nil {
+		return nil, err
+	}
+	if err := mediaEngine.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, err
+	}
+	if err := mediaEngine.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: DependencyDescriptorURI}, webrtc.RTPCodecTypeVideo,
+	); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if cfg.CongestionControl {
+		congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(
+				gcc.SendSideBWEInitialBitrate(cfg.InitialBitrate),
+				gcc.SendSideBWEMinBitrate(cfg.MinBitrate),
+				gcc.SendSideBWEMaxBitrate(cfg.MaxBitrate),
+			)
+		})
+		if err != nil {
+			return nil, err
+		}
+		congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			onEstimator(estimator)
+		})
+		registry.Add(congestionController)
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+			return nil, err
+		}
+	}
+	if err := registerInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+// registerInterceptors is webrtc.RegisterDefaultInterceptors without the NACK generator and
+// responder, the SFU sends its own NACKs to publishers and answers subscribers from its cache.
+// The NACK feedback itself comes with the video codecs, see registerCodecs.
+func registerInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return err
+	}
+	if err := webrtc.ConfigureStatsInterceptor(registry); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(mediaEngine, registry)
+}
@@ -5,7 +5,21 @@ let peerId = Math.random().toString(36).slice(2);
 
 let localStream = null;
 let cameraEnabled = true;
+let roomLocked = false;
+let roles = { owner: null, admins: [] };
+let roomPassword = ""; // Sets the password when we create the room, proves we know it otherwise
+// Join token issued by the backend, handed to this page as ?token=...
+const authToken = new URLSearchParams(window.location.search).get("token") || "";
 const remoteStreams = new Map(); // trackId -> { stream, videoElement }
+const peers = new Map(); // peerId -> roster entry { displayName, metadata, streamId, role, ... }
+let rosterVersion = 0;
+const dataChannels = new Map(); // label -> RTCDataChannel, relayed by the server to the other peers
+let screenStream = null;
+let screenSenders = [];
+let sharePending = false; // share-start sent, waiting for the server to accept it
+let presenterId = "";
+let roomCodecs = null; // Video MIME types the room negotiates, most preferred first ("codecs")
+let displayName = "";
 
 // --- Initialization ---
 window.addEventListener("load", async () => {
@@ -24,6 +38,8 @@ function joinRoomFromLobby() {
     alert("Please enter a Room ID");
     return;
   }
+  roomPassword = document.getElementById("lobbyPasswordInput").value;
+  displayName = document.getElementById("lobbyNameInput").value.trim();
   joinRoom(newRoomId);
 }
 
@@ -54,27 +70,8 @@ function connectWebSocket() {
     // Create PC *after* socket is open
     createPeerConnection();
 
-    // Send Join
-    ws.send(
-      JSON.stringify({
-        event: "join",
-        data: { roomId, peerId },
-      })
-    );
-
-    // Create & Send Offer
-    try {
-      const offer = await pc.createOffer();
-      await pc.setLocalDescription(offer);
-      ws.send(
-        JSON.stringify({
-          event: "offer",
-          data: offer.sdp,
-        })
-      );
-    } catch (e) {
-      console.error("Error creating offer:", e);
-    }
+    // Send Join, the offer follows once the server confirms we're in the room ("peer-id")
+    sendJoin();
   };
 
   ws.onmessage = handleWebSocketMessage;
@@ -114,26 +111,207 @@ async function handleWebSocketMessage(msg) {
     }
   }
 
+  if (message.event === "codecs") {
+    roomCodecs = message.data.video;
+    publishCamera(); // Its encodings depend on the room's codecs
+    applyCodecPreferences(pc);
+  }
+
+  if (message.event === "codec-unsupported") {
+    const name = peers.get(message.data.peerId)?.displayName || "A participant";
+    showNotification(`Your browser cannot play ${name}'s ${message.data.codec} track.`, "error");
+  }
+
   if (message.event === "peer-id") {
     peerId = message.data;
+    hideWaitingOverlay();
+    sendMediaState();
+    await sendOffer();
+  }
+
+  if (message.event === "auth-required" || message.event === "auth-failed") {
+    const { error, retryAfter } = message.data;
+    if (retryAfter) {
+      alert(`${error} (retry in ${retryAfter}s)`);
+      leaveRoom();
+      return;
+    }
+    const password = prompt(`${error}. Enter the room password:`);
+    if (password === null) {
+      leaveRoom();
+      return;
+    }
+    roomPassword = password;
+    sendJoin();
+  }
+
+  if (
+    message.event === "access-denied" ||
+    message.event === "evicted" ||
+    message.event === "unauthorized"
+  ) {
+    alert(message.data);
+    leaveRoom();
+  }
+
+  if (message.event === "waiting") {
+    showWaitingOverlay();
+  }
+
+  if (message.event === "denied") {
+    alert(`You were not admitted: ${message.data}`);
+    leaveRoom();
+  }
+
+  if (message.event === "waiting-peer") {
+    showKnock(message.data);
+  }
+
+  if (message.event === "waiting-peer-removed") {
+    removeKnock(message.data.peerId);
+  }
+
+  if (message.event === "room-locked") {
+    roomLocked = message.data.locked;
+    const lockBtn = document.getElementById("lockBtn");
+    lockBtn.classList.toggle("locked", roomLocked);
+    lockBtn.textContent = roomLocked ? "Unlock Room" : "Lock Room";
+    showNotification(roomLocked ? "The room is now locked." : "The room is now unlocked.");
+  }
+
+  if (message.event === "roles-changed") {
+    const wasOwner = roles.owner === peerId;
+    roles = message.data;
+    trackRosterVersion(roles.version);
+    peers.forEach((info, id) => {
+      info.role =
+        roles.owner === id
+          ? "owner"
+          : roles.admins.includes(id)
+          ? "admin"
+          : "participant";
+    });
+    if (!wasOwner && roles.owner === peerId) {
+      showNotification("You are now the owner of this room.");
+    }
+    document.body.classList.toggle(
+      "is-moderator",
+      roles.owner === peerId || roles.admins.includes(peerId)
+    );
+  }
+
+  if (message.event === "moderation") {
+    handleModeration(message.data);
+  }
+
+  if (message.event === "error") {
+    if (message.data.event === "share-start" && sharePending) {
+      stopScreenStream();
+    }
+    showNotification(`${message.data.event}: ${message.data.error}`, "error");
+  }
+
+  if (message.event === "roster") {
+    rosterVersion = message.data.version;
+    presenterId = message.data.presenter || "";
+    peers.clear();
+    message.data.peers.forEach((info) => {
+      peers.set(info.peerId, info);
+      updateStreamLabel(info.streamId);
+    });
+  }
+
+  if (message.event === "peer-joined") {
+    const { version, peer: info } = message.data;
+    trackRosterVersion(version);
+    peers.set(info.peerId, info);
+    updateStreamLabel(info.streamId);
+    showNotification(`${info.displayName || "A participant"} joined the room.`);
+  }
+
+  if (message.event === "peer-updated") {
+    const { version, peer: info } = message.data;
+    trackRosterVersion(version);
+    peers.set(info.peerId, info);
+    updateStreamLabel(info.streamId);
   }
 
   if (message.event === "peer-left") {
-    const removedPeerId = message.data;
+    const { version, peerId: removedPeerId } = message.data;
+    trackRosterVersion(version);
     const peerName = removeRemoteStream(removedPeerId); // Logic corrected to pass peerId
+    removeRemoteStream(`screen-${removedPeerId}`); // Their screen share goes with them
 
+    peers.delete(removedPeerId);
     if (peerName) {
       showNotification(`${peerName} has left the room.`);
     }
   }
 
+  if (message.event === "presenter-changed") {
+    presenterId = message.data.peerId;
+    remoteStreams.forEach((_, streamId) => updateStreamLabel(streamId));
+    if (sharePending && presenterId === peerId) {
+      publishScreenShare();
+    }
+  }
+
+  if (message.event === "stats") {
+    window.dispatchEvent(new CustomEvent("receive-stats", { detail: message.data.tracks }));
+  }
+
+  if (message.event === "chat") {
+    appendChatMessage(message.data);
+  }
+
+  if (message.event === "chat-history") {
+    message.data.forEach(appendChatMessage);
+  }
+
   if (message.event === "room-full") {
-    alert("The room is full.");
+    const { capacity, occupancy } = message.data || {};
+    alert(
+      capacity
+        ? `The room is full (${occupancy}/${capacity} participants).`
+        : "The room is full."
+    );
     leaveRoom();
   }
 }
 
+function sendJoin() {
+  ws.send(
+    JSON.stringify({
+      event: "join",
+      data: {
+        roomId,
+        peerId,
+        password: roomPassword,
+        token: authToken,
+        displayName,
+      },
+    })
+  );
+}
+
+async function sendOffer() {
+  if (!pc) return;
+  try {
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    ws.send(
+      JSON.stringify({
+        event: "offer",
+        data: offer.sdp,
+      })
+    );
+  } catch (e) {
+    console.error("Error creating offer:", e);
+  }
+}
+
 function leaveRoom() {
+  stopScreenStream();
   // Close Peer Connection and WebSocket
   if (pc) {
     pc.close();
@@ -148,6 +326,9 @@ function leaveRoom() {
 
   // Clear UI and switch to lobby
   clearAllRemoteStreams();
+  hideWaitingOverlay();
+  document.querySelectorAll(".knock-toast").forEach((el) => el.remove());
+  document.getElementById("chatMessages").replaceChildren();
   switchView("lobby");
 }
 
@@ -159,6 +340,7 @@ function createPeerConnection() {
   });
 
   pc.ontrack = handleTrackEvent;
+  pc.ondatachannel = (event) => registerDataChannel(event.channel);
   pc.onicecandidate = (event) => {
     if (event.candidate && ws && ws.readyState === WebSocket.OPEN) {
       ws.send(
@@ -175,10 +357,51 @@ function createPeerConnection() {
   };
 
   if (localStream) {
-    localStream.getTracks().forEach((track) => pc.addTrack(track, localStream));
+    localStream.getAudioTracks().forEach((track) => pc.addTrack(track, localStream));
   }
+  // The camera is published and the codecs ordered once the room being joined sends its codecs
+  roomCodecs = null;
+
+  // Opened up front so the first offer already negotiates the SCTP association
+  dataChannels.clear();
+  openDataChannel("events");
+}
 
-  forceVP8(pc);
+// Channels with the same label are bridged by the server. Pass { ordered: false, maxRetransmits: 0 }
+// for lossy data like cursor positions, the relay keeps the same delivery mode.
+function openDataChannel(label, options = {}) {
+  if (dataChannels.has(label)) return dataChannels.get(label);
+  return registerDataChannel(pc.createDataChannel(label, options));
+}
+
+function registerDataChannel(channel) {
+  if (!dataChannels.has(channel.label)) dataChannels.set(channel.label, channel);
+  channel.binaryType = "arraybuffer";
+  channel.onmessage = (event) => handleDataMessage(channel.label, event.data);
+  channel.onclose = () => {
+    if (dataChannels.get(channel.label) === channel) dataChannels.delete(channel.label);
+  };
+  return channel;
+}
+
+function sendData(label, data) {
+  const channel = dataChannels.get(label);
+  if (!channel || channel.readyState !== "open") return false;
+  channel.send(data);
+  return true;
+}
+
+// Relayed messages start with the sender's peer id (36 characters)
+function handleDataMessage(label, data) {
+  let from, payload;
+  if (typeof data === "string") {
+    from = data.slice(0, 36);
+    payload = data.slice(36);
+  } else {
+    from = new TextDecoder().decode(data.slice(0, 36));
+    payload = data.slice(36);
+  }
+  window.dispatchEvent(new CustomEvent("peer-data", { detail: { label, from, data: payload } }));
 }
 
 function handleTrackEvent(event) {
@@ -207,9 +430,10 @@ function handleTrackEvent(event) {
   overlay.className = "video-overlay";
   const label = document.createElement("span");
   label.className = "video-label";
-  label.textContent = `Peer ${remoteStreams.size + 1}`;
+  label.textContent = peerLabel(streamId, `Peer ${remoteStreams.size + 1}`);
 
   overlay.appendChild(label);
+  overlay.appendChild(createModerationControls(streamPeerId(streamId)));
   videoContainer.appendChild(video);
   videoContainer.appendChild(overlay);
 
@@ -219,6 +443,7 @@ function handleTrackEvent(event) {
     stream,
     container: videoContainer,
   });
+  updateStreamLabel(streamId);
 
   // Handle track removal if needed, though usually we rely on peer-left
   stream.onremovetrack = () => {
@@ -228,6 +453,41 @@ function handleTrackEvent(event) {
   };
 }
 
+// Every roster event bumps the version by one, a gap means we missed one so we ask for a fresh roster
+function trackRosterVersion(version) {
+  if (version !== rosterVersion + 1) {
+    ws.send(JSON.stringify({ event: "get-roster" }));
+  }
+  rosterVersion = version;
+}
+
+// Camera tracks arrive in "stream-<peerId>", screen shares in "screen-<peerId>"
+function streamPeerId(streamId) {
+  return streamId.replace(/^(stream|screen)-/, "");
+}
+
+function peerLabel(streamId, fallback) {
+  const info = peers.get(streamPeerId(streamId));
+  const name = (info && info.displayName) || fallback;
+  return streamId.startsWith("screen-") ? `${name} (screen)` : name;
+}
+
+function updateStreamLabel(streamId) {
+  const remote = remoteStreams.get(streamId);
+  if (!remote) return;
+  const label = remote.container.querySelector(".video-label");
+  label.textContent = peerLabel(streamId, label.textContent);
+  remote.container.classList.toggle(
+    "presenting",
+    streamId === `screen-${presenterId}`
+  );
+
+  const info = peers.get(streamPeerId(streamId));
+  if (!info || streamId.startsWith("screen-")) return;
+  remote.container.classList.toggle("remote-muted", info.audioMuted);
+  remote.container.classList.toggle("remote-video-off", info.videoOff);
+}
+
 function removeRemoteStream(idOrPeerId) {
   // Try direct match first
   let streamId = idOrPeerId;
@@ -252,6 +512,7 @@ function removeRemoteStream(idOrPeerId) {
 function clearAllRemoteStreams() {
   remoteStreams.forEach((remote) => remote.container.remove());
   remoteStreams.clear();
+  peers.clear();
 }
 
 async function startLocalStream() {
@@ -290,6 +551,7 @@ function toggleCamera() {
     document
       .getElementById("cameraBtn")
       .classList.toggle("camera-off", !cameraEnabled);
+    sendMediaState();
   }
 }
 
@@ -301,25 +563,156 @@ function toggleMic() {
     document
       .getElementById("micBtn")
       .classList.toggle("mic-off", !audioTrack.enabled);
+    sendMediaState();
   }
 }
 
-function forceVP8(pc) {
-  const transceivers = pc.getTransceivers();
-  transceivers.forEach((t) => {
-    if (t.sender.track && t.sender.track.kind === "video") {
-      const capabilities = RTCRtpSender.getCapabilities("video");
-      if (!capabilities) return;
-      const vp8Codecs = capabilities.codecs.filter(
-        (c) => c.mimeType.toLowerCase() === "video/vp8"
-      );
-      if (vp8Codecs.length > 0) {
-        try {
-          t.setCodecPreferences(vp8Codecs);
-        } catch (e) {
-          console.warn(e);
-        }
-      }
+// The server has to know which tracks are the screen share before they arrive, so we announce
+// them first and only publish once it made us the presenter (presenter-changed)
+async function toggleScreenShare() {
+  if (screenStream) {
+    stopScreenShare();
+    return;
+  }
+  if (!pc || sharePending) return;
+  try {
+    screenStream = await navigator.mediaDevices.getDisplayMedia({
+      video: true,
+      audio: true,
+    });
+  } catch (e) {
+    console.warn("Screen share cancelled:", e);
+    return;
+  }
+  screenStream.getVideoTracks()[0].onended = stopScreenShare; // Browser's own "Stop sharing" button
+  sharePending = true;
+  ws.send(
+    JSON.stringify({
+      event: "share-start",
+      data: { trackIds: screenStream.getTracks().map((track) => track.id) },
+    })
+  );
+}
+
+function publishScreenShare() {
+  sharePending = false;
+  screenSenders = screenStream
+    .getTracks()
+    .map((track) => pc.addTrack(track, screenStream));
+  applyCodecPreferences(pc);
+  document.getElementById("shareBtn").classList.add("sharing");
+  sendOffer();
+}
+
+function stopScreenShare() {
+  if (!screenStream) return;
+  const published = screenSenders.length > 0;
+  stopScreenStream();
+  if (ws && ws.readyState === WebSocket.OPEN) {
+    ws.send(JSON.stringify({ event: "share-stop" }));
+  }
+  if (published) sendOffer();
+}
+
+function stopScreenStream() {
+  if (pc) {
+    screenSenders.forEach((sender) => pc.removeTrack(sender));
+  }
+  screenSenders = [];
+  sharePending = false;
+  if (screenStream) {
+    screenStream.getTracks().forEach((track) => track.stop());
+    screenStream = null;
+  }
+  document.getElementById("shareBtn").classList.remove("sharing");
+}
+
+// Asks for the "low", "mid" or "high" simulcast layer of a peer's video, trackId picks one of its
+// tracks (camera or screen share), all of them by default
+function requestLayer(remotePeerId, layer, trackId = "") {
+  if (!ws || ws.readyState !== WebSocket.OPEN) return;
+  ws.send(
+    JSON.stringify({
+      event: "set-layer",
+      data: { peerId: remotePeerId, trackId, layer },
+    })
+  );
+}
+
+// Asks for the loss, jitter and round trip time we reported for each track we receive, the
+// answer comes as a "receive-stats" event on window
+function requestStats() {
+  if (!ws || ws.readyState !== WebSocket.OPEN) return;
+  ws.send(JSON.stringify({ event: "get-stats" }));
+}
+
+// Tells the others what our media looks like, they can't tell a muted track from a silent one
+function sendMediaState() {
+  if (!ws || ws.readyState !== WebSocket.OPEN || !localStream) return;
+  const audioTrack = localStream.getAudioTracks()[0];
+  ws.send(
+    JSON.stringify({
+      event: "media-state",
+      data: {
+        audioMuted: !audioTrack || !audioTrack.enabled,
+        videoOff: !cameraEnabled,
+      },
+    })
+  );
+}
+
+// Sends the camera once the room's codecs are known. With VP9 or AV1 preferred it goes out as one
+// scalable stream the server thins out per subscriber, otherwise in three simulcast layers the
+// server forwards each subscriber one of.
+function publishCamera() {
+  if (!pc || !localStream || !roomCodecs) return;
+  const track = localStream.getVideoTracks()[0];
+  if (!track || pc.getSenders().some((sender) => sender.track === track)) return;
+  pc.addTransceiver(track, {
+    direction: "sendrecv",
+    streams: [localStream],
+    sendEncodings: supportsScalability(roomCodecs[0], "L3T3_KEY")
+      ? [{ scalabilityMode: "L3T3_KEY", maxBitrate: 1500000 }]
+      : [
+          { rid: "q", scaleResolutionDownBy: 4, maxBitrate: 150000 },
+          { rid: "h", scaleResolutionDownBy: 2, maxBitrate: 500000 },
+          { rid: "f", maxBitrate: 1500000 },
+        ],
+  });
+}
+
+function supportsScalability(mimeType, mode) {
+  if (!mimeType || !["video/vp9", "video/av1"].includes(mimeType.toLowerCase())) return false;
+  const capabilities = RTCRtpSender.getCapabilities && RTCRtpSender.getCapabilities("video");
+  return !!capabilities?.codecs.some(
+    (codec) =>
+      codec.mimeType.toLowerCase() === mimeType.toLowerCase() && codec.scalabilityModes?.includes(mode)
+  );
+}
+
+// Orders the video codecs of every transceiver by the room's preference and leaves out the ones
+// it doesn't allow, retransmission and FEC entries are kept
+function applyCodecPreferences(pc) {
+  const capabilities = RTCRtpReceiver.getCapabilities && RTCRtpReceiver.getCapabilities("video");
+  if (!pc || !roomCodecs || !capabilities) return;
+  const rank = (codec) =>
+    roomCodecs.findIndex((mime) => mime.toLowerCase() === codec.mimeType.toLowerCase());
+  const preferred = capabilities.codecs
+    .filter((codec) => rank(codec) >= 0)
+    .sort((a, b) => rank(a) - rank(b));
+  if (preferred.length === 0) {
+    showNotification("Your browser supports none of this room's video codecs.", "error");
+    return;
+  }
+  const repair = capabilities.codecs.filter((codec) =>
+    ["video/rtx", "video/red", "video/ulpfec"].includes(codec.mimeType.toLowerCase())
+  );
+  pc.getTransceivers().forEach((t) => {
+    if (t.receiver.track.kind !== "video" || t.currentDirection === "stopped") return;
+    try {
+      t.setCodecPreferences([...preferred, ...repair]);
+    } catch (e) {
+      console.warn(e);
     }
   });
 }
@@ -341,3 +734,140 @@ function showNotification(message, type = "info") {
     });
   }, 3000);
 }
+
+// --- Waiting room ---
+
+function toggleRoomLock() {
+  if (!ws || ws.readyState !== WebSocket.OPEN) return;
+  ws.send(JSON.stringify({ event: roomLocked ? "unlock-room" : "lock-room" }));
+}
+
+function showWaitingOverlay() {
+  document.getElementById("waitingOverlay").classList.remove("hidden");
+}
+
+function hideWaitingOverlay() {
+  document.getElementById("waitingOverlay").classList.add("hidden");
+}
+
+function showKnock({ peerId: waitingId, displayName }) {
+  if (document.getElementById(`knock-${waitingId}`)) return;
+  const container = document.getElementById("notificationContainer");
+
+  const toast = document.createElement("div");
+  toast.className = "notification-toast info knock-toast";
+  toast.id = `knock-${waitingId}`;
+
+  const text = document.createElement("span");
+  text.textContent = `${displayName || "Someone"} wants to join.`;
+
+  const respond = (event) => {
+    ws.send(JSON.stringify({ event, data: { peerId: waitingId } }));
+    toast.remove();
+  };
+  const admit = document.createElement("button");
+  admit.className = "btn primary";
+  admit.textContent = "Admit";
+  admit.onclick = () => respond("admit");
+  const deny = document.createElement("button");
+  deny.className = "btn";
+  deny.textContent = "Deny";
+  deny.onclick = () => respond("deny");
+
+  toast.append(text, admit, deny);
+  container.appendChild(toast);
+}
+
+function removeKnock(waitingId) {
+  const toast = document.getElementById(`knock-${waitingId}`);
+  if (toast) toast.remove();
+}
+
+// --- Moderation ---
+
+function createModerationControls(targetId) {
+  const controls = document.createElement("div");
+  controls.className = "mod-controls";
+  const actions = [
+    ["Mute", "mute-peer"],
+    ["Stop video", "disable-video"],
+    ["Kick", "kick"],
+  ];
+  actions.forEach(([text, event]) => {
+    const button = document.createElement("button");
+    button.className = "btn";
+    button.textContent = text;
+    button.onclick = () =>
+      ws.send(JSON.stringify({ event, data: { peerId: targetId } }));
+    controls.appendChild(button);
+  });
+  return controls;
+}
+
+function handleModeration({ action, peerId: targetId, reason }) {
+  const suffix = reason ? ` (${reason})` : "";
+  if (targetId !== peerId) {
+    const descriptions = {
+      kick: "was removed from the room",
+      mute: "was muted by a moderator",
+      unmute: "can speak again",
+      "disable-video": "had their video stopped by a moderator",
+      "enable-video": "can share video again",
+    };
+    showNotification(`A participant ${descriptions[action] || action}${suffix}.`);
+    return;
+  }
+
+  if (action === "kick") {
+    alert(`You were removed from the room${suffix}.`);
+    leaveRoom();
+  } else if (action === "mute") {
+    const audioTrack = localStream && localStream.getAudioTracks()[0];
+    if (audioTrack) audioTrack.enabled = false;
+    document.getElementById("micBtn").classList.add("mic-off");
+    sendMediaState();
+    showNotification(`A moderator muted you${suffix}.`, "error");
+  } else if (action === "disable-video") {
+    showNotification(`A moderator stopped your video${suffix}.`, "error");
+  } else {
+    showNotification(`A moderator lifted a restriction (${action}).`);
+  }
+}
+
+// --- Chat ---
+
+function toggleChat() {
+  document.getElementById("chatPanel").classList.toggle("hidden");
+}
+
+function sendChat(event) {
+  event.preventDefault();
+  const input = document.getElementById("chatInput");
+  const text = input.value.trim();
+  if (!text || !ws || ws.readyState !== WebSocket.OPEN) return;
+  ws.send(JSON.stringify({ event: "chat", data: { text } }));
+  input.value = "";
+}
+
+function appendChatMessage({ from, fromName, to, text, sentAt }) {
+  const container = document.getElementById("chatMessages");
+  const item = document.createElement("div");
+  item.className = to ? "chat-message private" : "chat-message";
+
+  const author = document.createElement("span");
+  author.className = "chat-author";
+  author.textContent = from === peerId ? "You" : fromName || "Guest";
+  const time = document.createElement("span");
+  time.className = "chat-time";
+  time.textContent = new Date(sentAt).toLocaleTimeString();
+  const body = document.createElement("div");
+  body.textContent = text;
+
+  item.append(author, time, body);
+  container.appendChild(item);
+  container.scrollTop = container.scrollHeight;
+
+  if (from !== peerId && document.getElementById("chatPanel").classList.contains("hidden")) {
+    showNotification(`${fromName || "Guest"}: ${text}`);
+  }
+}